@@ -1,23 +1,52 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"html"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
 
-	//	"github.com/gorilla/feeds"
+	"github.com/chai2010/webp"
+	"github.com/gorilla/feeds"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/shurcooL/github_flavored_markdown"
 	"golang.org/x/crypto/bcrypt"
@@ -29,32 +58,147 @@ type User struct {
 	Userid    int64  `json:"userid"`
 	Username  string `json:"username"`
 	HashedPwd string `json:"hashedpwd"`
+	Role      string `json:"role"`
+	Quota     int64  `json:"quota"`
 }
+
+// User roles
+const (
+	RoleAdmin       = "admin"
+	RoleEditor      = "editor"
+	RoleAuthor      = "author"
+	RoleContributor = "contributor"
+)
+
+// Permissions granted to roles
+const (
+	PermPublish        = "publish"        // publish or schedule own entries
+	PermEditAllEntries = "editallentries" // view, edit and delete anyone's entries
+	PermModerateAll    = "moderateall"    // moderate comments on anyone's entries
+	PermEditAllFiles   = "editallfiles"   // edit and delete anyone's files
+	PermManageSite     = "managesite"     // change site settings
+	PermManageUsers    = "manageusers"    // assign roles, change or delete other users
+)
+
+var rolePerms = map[string][]string{
+	RoleAdmin:       {PermPublish, PermEditAllEntries, PermModerateAll, PermEditAllFiles, PermManageSite, PermManageUsers},
+	RoleEditor:      {PermPublish, PermEditAllEntries, PermModerateAll},
+	RoleAuthor:      {PermPublish},
+	RoleContributor: {},
+}
+
 type Entry struct {
+	Entryid   int64  `json:"entryid"`
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	Createdt  string `json:"createdt"`
+	Userid    int64  `json:"userid"`
+	Username  string `json:"username"`
+	Tags      string `json:"tags"`
+	Status    string `json:"status"`
+	Publishat string `json:"publishat"`
+	Slug      string `json:"slug"`
+	Snippet   string `json:"snippet,omitempty"`
+}
+
+// Entry status values
+const (
+	EntryDraft     = "draft"
+	EntryPublished = "published"
+	EntryScheduled = "scheduled"
+)
+
+type EntryRevision struct {
 	Entryid  int64  `json:"entryid"`
+	Rev      int64  `json:"rev"`
 	Title    string `json:"title"`
 	Body     string `json:"body"`
+	Tags     string `json:"tags"`
 	Createdt string `json:"createdt"`
 	Userid   int64  `json:"userid"`
 	Username string `json:"username"`
-	Tags     string `json:"tags"`
 }
+type Comment struct {
+	Commentid int64  `json:"commentid"`
+	Entryid   int64  `json:"entryid"`
+	Parentid  int64  `json:"parentid"`
+	Userid    int64  `json:"userid"`
+	Name      string `json:"name"`
+	Body      string `json:"body"`
+	Createdt  string `json:"createdt"`
+	Status    string `json:"status"`
+}
+
+// Comment moderation status values
+const (
+	CommentPending  = "pending"
+	CommentApproved = "approved"
+	CommentRejected = "rejected"
+)
+
 type File struct {
 	Fileid   int64  `json:"fileid"`
 	Filename string `json:"filename"`
 	Title    string `json:"title"`
 	Url      string `json:"url"`
-	Bytes    []byte `json:"bytes"`
+	Bytes    []byte `json:"bytes,omitempty"`
+	Blobkey  string `json:"-"`
+	Size     int64  `json:"size"`
+	Mimetype string `json:"mimetype"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
 	Createdt string `json:"createdt"`
 	Userid   int64  `json:"userid"`
 	Username string `json:"username"`
 }
+
+// Resized copy of an image file.
+type ImageVariant struct {
+	Fileid   int64
+	Width    int
+	Blobkey  string
+	Size     int64
+	Mimetype string
+}
 type Site struct {
 	Siteid  int64  `json:"siteid"`
 	Title   string `json:"title"`
 	About   string `json:"about"`
 	IsGroup bool   `json:"isgroup"`
+
+	// Keep EXIF/XMP metadata of uploaded photos. Stripped by default.
+	KeepMetadata bool `json:"keepmetadata"`
 }
+type Session struct {
+	Sessionid int64  `json:"sessionid"`
+	Userid    int64  `json:"userid"`
+	Createdt  string `json:"createdt"`
+	Lastusedt string `json:"lastusedt"`
+	Expiresat string `json:"expiresat"`
+	Useragent string `json:"useragent"`
+	Ip        string `json:"ip"`
+	Current   bool   `json:"current"`
+}
+type ApiToken struct {
+	Tokenid   int64  `json:"tokenid"`
+	Userid    int64  `json:"userid"`
+	Name      string `json:"name"`
+	Scopes    string `json:"scopes"`
+	Createdt  string `json:"createdt"`
+	Lastusedt string `json:"lastusedt"`
+	Token     string `json:"token,omitempty"`
+}
+
+// Api token scopes
+const (
+	ScopeRead         = "read"
+	ScopeEntriesWrite = "entries:write"
+	ScopeFilesWrite   = "files:write"
+)
+
+// All api tokens start with this prefix to tell them apart from session tokens.
+const apiTokenPrefix = "fbt_"
+
 type UserSettings struct {
 	Userid    int64  `json:"userid"`
 	BlogTitle string `json:"blogtitle"`
@@ -66,6 +210,7 @@ type PageParams struct {
 	BlogUserid   int64
 	BlogUsername string
 	BaseUrl      string
+	Static       bool // rendering for export-static, leave out server-only features
 }
 
 func jsonstr(v interface{}) string {
@@ -79,6 +224,73 @@ func fileurl(f *File) string {
 	return fmt.Sprintf("/?page=file&id=%d", f.Fileid)
 }
 
+// Returns canonical url of entry.
+// Ex. "/user123/2026/10/my-post"
+func entryurl(e *Entry) string {
+	if e.Slug == "" {
+		return fmt.Sprintf("/?page=entry&id=%d", e.Entryid)
+	}
+	if e.Username == "" {
+		return fmt.Sprintf("/post/%s", pathescape(e.Slug))
+	}
+	t := parseisodate(e.Createdt)
+	return fmt.Sprintf("/%s/%s/%s", pathescape(e.Username), t.Format("2006/01"), pathescape(e.Slug))
+}
+
+// Server settings. Defaults are overridden by the -config json file, which
+// is overridden by command line switches.
+type Config struct {
+	Dbfile         string   `json:"db"`
+	Listen         string   `json:"listen"`
+	StaticDir      string   `json:"staticdir"`
+	BaseUrl        string   `json:"baseurl"`
+	TlsCert        string   `json:"tlscert"`
+	TlsKey         string   `json:"tlskey"`
+	RedirectHttp   string   `json:"redirecthttp"`
+	Hsts           string   `json:"hsts"`
+	LogLevel       string   `json:"loglevel"`
+	TrustedProxies []string `json:"trustedproxies"`
+	Blobs          string   `json:"blobs"`
+	FileCache      string   `json:"filecache"`
+	MaxFileSize    string   `json:"maxfilesize"`
+	MaxUpload      string   `json:"maxupload"`
+	Quota          string   `json:"quota"`
+	ReadTimeout    string   `json:"readtimeout"`
+	WriteTimeout   string   `json:"writetimeout"`
+	IdleTimeout    string   `json:"idletimeout"`
+	Webhook        string   `json:"webhook"`
+}
+
+// Log levels
+const (
+	LogDebug = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+var logLevel = LogInfo
+
+// Public url of site, ex. "https://blog.example.com". If empty, it is
+// taken from the request host.
+var siteBaseUrl = ""
+
+// Reverse proxies whose X-Forwarded-For and X-Forwarded-Proto headers are trusted.
+var trustedProxies []*net.IPNet
+
+// Strict-Transport-Security max-age sent on https responses, set by -hsts.
+// Zero doesn't send the header.
+var hstsMaxAge = 365 * 24 * time.Hour
+
+// http.Server timeouts, so slow or idle clients don't hold connections forever.
+var serverReadTimeout = 5 * time.Minute
+var serverWriteTimeout = 5 * time.Minute
+var serverIdleTimeout = 2 * time.Minute
+
+// How long to wait for in-flight requests to finish on shutdown.
+var shutdownTimeout = 30 * time.Second
+
 func main() {
 	err := run(os.Args[1:])
 	if err != nil {
@@ -99,38 +311,333 @@ func run(args []string) error {
 		return nil
 	}
 
-	// Need to specify a db file as first parameter.
-	if len(parms) == 0 {
+	// migrate [--dryrun] [db_file]  Update db schema to the current version
+	migrate := len(parms) > 0 && parms[0] == "migrate"
+	if migrate {
+		parms = parms[1:]
+	}
+
+	// export-static <db_file> <outdir>  Write site as static html files
+	exportdir := ""
+	if len(parms) > 0 && parms[0] == "export-static" {
+		if len(parms) != 3 {
+			return fmt.Errorf("Usage: freeblog export-static <db file> <output dir>\n")
+		}
+		exportdir = parms[2]
+		parms = parms[1:2]
+	}
+
+	// import <db_file> <wordpress.xml | markdown_dir | markdown.zip>  Import posts
+	importsrc := ""
+	if len(parms) > 0 && parms[0] == "import" {
+		if len(parms) != 3 {
+			return fmt.Errorf("Usage: freeblog import [-author <username>] <db file> <wordpress.xml | markdown dir | markdown.zip>\n")
+		}
+		importsrc = parms[2]
+		parms = parms[1:2]
+	}
+
+	// backup <db_file> <out.tar.gz>  Write site to a backup archive
+	// restore <in.tar.gz> <new_db_file>  Create db from a backup archive
+	backupfile, restorefile := "", ""
+	if len(parms) > 0 && (parms[0] == "backup" || parms[0] == "restore") {
+		if len(parms) != 3 {
+			return fmt.Errorf("Usage:\n\tfreeblog backup <db file> <backup.tar.gz>\n\tfreeblog restore <backup.tar.gz> <new db file>\n")
+		}
+		if parms[0] == "backup" {
+			backupfile = parms[2]
+			parms = parms[1:2]
+		} else {
+			restorefile = parms[1]
+			parms = parms[2:3]
+		}
+	}
+
+	cfg, err := loadConfig(sw, parms)
+	if err != nil {
+		return err
+	}
+
+	if exportdir != "" {
+		err = applyConfig(cfg)
+		if err != nil {
+			return err
+		}
+		dbfile := cfg.Dbfile
+		if !fileExists(dbfile) {
+			return fmt.Errorf("Database file '%s' doesn't exist.\n", dbfile)
+		}
+		db, err := openDB(dbfile)
+		if err != nil {
+			return fmt.Errorf("Error opening '%s' (%s)\n", dbfile, err)
+		}
+		defer db.Close()
+		_, err = migrateDB(db, os.Stdout, false)
+		if err != nil {
+			return err
+		}
+		blobs, err = openBlobStore(cfg.Blobs, dbfile)
+		if err != nil {
+			return err
+		}
+		npages, nfiles, err := exportStatic(db, cfg.StaticDir, exportdir)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Exported %d page(s) and %d file(s) to %s\n", npages, nfiles, exportdir)
+		return nil
+	}
+
+	if importsrc != "" {
+		err = applyConfig(cfg)
+		if err != nil {
+			return err
+		}
+		dbfile := cfg.Dbfile
+		if !fileExists(dbfile) {
+			return fmt.Errorf("Database file '%s' doesn't exist.\n", dbfile)
+		}
+		db, err := openDB(dbfile)
+		if err != nil {
+			return fmt.Errorf("Error opening '%s' (%s)\n", dbfile, err)
+		}
+		defer db.Close()
+		_, err = migrateDB(db, os.Stdout, false)
+		if err != nil {
+			return err
+		}
+		blobs, err = openBlobStore(cfg.Blobs, dbfile)
+		if err != nil {
+			return err
+		}
+		author := findFirstAdmin(db, 0)
+		if sw["author"] != "" {
+			author = findUserByUsername(db, sw["author"])
+			if author == nil {
+				return fmt.Errorf("User '%s' not found.\n", sw["author"])
+			}
+		}
+		if author == nil {
+			return fmt.Errorf("No admin user found to own the imported entries, use -author.\n")
+		}
+		res, err := importSource(db, importsrc, author)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d entries and %d files, %d warning(s).\n", res.Entries, res.Files, len(res.Warnings))
+		return nil
+	}
+
+	if backupfile != "" {
+		dbfile := cfg.Dbfile
+		if !fileExists(dbfile) {
+			return fmt.Errorf("Database file '%s' doesn't exist.\n", dbfile)
+		}
+		db, err := openDB(dbfile)
+		if err != nil {
+			return fmt.Errorf("Error opening '%s' (%s)\n", dbfile, err)
+		}
+		defer db.Close()
+		blobs, err = openBlobStore(cfg.Blobs, dbfile)
+		if err != nil {
+			return err
+		}
+		err = backupSite(db, backupfile)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Backed up '%s' to %s\n", dbfile, backupfile)
+		return nil
+	}
+
+	if restorefile != "" {
+		dbfile := cfg.Dbfile
+		if fileExists(dbfile) {
+			return fmt.Errorf("File '%s' already exists. Restore to a new database file.\n", dbfile)
+		}
+		db, err := openDB(dbfile)
+		if err != nil {
+			return fmt.Errorf("Error opening '%s' (%s)\n", dbfile, err)
+		}
+		_, err = migrateDB(db, io.Discard, false)
+		if err == nil {
+			blobs, err = openBlobStore(cfg.Blobs, dbfile)
+		}
+		if err == nil {
+			err = restoreSite(db, restorefile)
+		}
+		db.Close()
+		if err != nil {
+			// Don't leave a partly restored db behind.
+			for _, ext := range []string{"", "-wal", "-shm"} {
+				os.Remove(dbfile + ext)
+			}
+			return err
+		}
+		fmt.Printf("Restored %s to '%s'\n", restorefile, dbfile)
+		return nil
+	}
+
+	if migrate {
+		dbfile := cfg.Dbfile
+		if !fileExists(dbfile) {
+			return fmt.Errorf("Database file '%s' doesn't exist.\n", dbfile)
+		}
+		db, err := openDB(dbfile)
+		if err != nil {
+			return fmt.Errorf("Error opening '%s' (%s)\n", dbfile, err)
+		}
+		defer db.Close()
+		dryrun := sw["dryrun"] != ""
+		n, err := migrateDB(db, os.Stdout, dryrun)
+		if err != nil {
+			return err
+		}
+		if dryrun {
+			fmt.Printf("%d migration(s) pending.\n", n)
+		} else {
+			fmt.Printf("Applied %d migration(s).\n", n)
+		}
+		return nil
+	}
+
+	// [-moveblobs db_file]  Move file contents out of the db into the blob store
+	if sw["moveblobs"] != "" {
+		dbfile := sw["moveblobs"]
+		if !fileExists(dbfile) {
+			return fmt.Errorf("Database file '%s' doesn't exist.\n", dbfile)
+		}
+		db, err := openDB(dbfile)
+		if err != nil {
+			return fmt.Errorf("Error opening '%s' (%s)\n", dbfile, err)
+		}
+		defer db.Close()
+		_, err = migrateDB(db, os.Stdout, false)
+		if err != nil {
+			return err
+		}
+		blobs, err = openBlobStore(cfg.Blobs, dbfile)
+		if err != nil {
+			return err
+		}
+		n, err := moveBlobs(db, blobs)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Moved %d file(s) to blob store.\n", n)
+		return nil
+	}
+
+	// Need to specify a db file as first parameter or in config file.
+	if cfg.Dbfile == "" {
 		s := `Usage:
 
    Start webservice using database file:
-	freeblog <db file> [port]
+	freeblog [options] <db file> [port]
+	freeblog -config <config file>
 
    Initialize new database file:
 	freeblog -i <new db file>
 
+   Move file contents stored in the database to the blob store:
+	freeblog -moveblobs <db file>
+
+   Update database schema (also done on startup). --dryrun prints the
+   pending sql without applying it:
+	freeblog migrate [--dryrun] <db file>
+
+   Write the public pages and files as a static html site:
+	freeblog export-static <db file> <output dir>
+
+   Import posts from a WordPress export (.xml) or Hugo/Jekyll markdown
+   files (directory or .zip). -author owns entries whose author isn't
+   a user here (default: admin):
+	freeblog import [-author <username>] <db file> <source>
+
+   Back up site to an archive (safe while the server is running), and
+   restore it to a new database file:
+	freeblog backup <db file> <backup.tar.gz>
+	freeblog restore <backup.tar.gz> <new db file>
+
+   Options (as "-name value" or "-name=value"):
+	-config <file>  JSON file with any of the options below, plus "db".
+	                Ex. {"db": "/var/lib/freeblog/blog.db", "listen": ":8000",
+	                     "trustedproxies": ["127.0.0.1"]}
+	-listen <addr>  Address to listen on (default: :8000).
+	-static <dir>   Directory of static files (default: ./static).
+	-baseurl <url>  Public url of the site, ex. https://blog.example.com
+	                (default: taken from request host).
+	-tlscert <file>, -tlskey <file>  Serve https using certificate and key.
+	                Send SIGHUP to reload them after renewing the certificate.
+	-redirecthttp <addr>  With https, also listen for http on addr (ex. :80)
+	                and redirect requests to https.
+	-hsts <duration>  Strict-Transport-Security max-age of https responses
+	                (default: 8760h, 0 to not send it).
+	-loglevel <level>  One of debug, info, warn, error (default: info).
+	-trustedproxies <ips>  Comma separated ips or cidrs of reverse proxies
+	                whose X-Forwarded-For/Proto headers are trusted.
+	-blobs <store>  Where uploaded files are stored. One of:
+	                <dir>  local directory (default: <db file>.blobs)
+	                s3://<bucket>?endpoint=<url>&region=<region>
+	                S3 credentials are read from AWS_ACCESS_KEY_ID and
+	                AWS_SECRET_ACCESS_KEY.
+	-filecache <duration>  How long clients may cache served files
+	                before revalidating (default: 24h, 0 to always revalidate).
+	-maxfilesize <size>  Largest file that can be uploaded (default: 32MB).
+	-maxupload <size>    Largest upload request (default: 128MB).
+	-quota <size>        Default storage quota per user (default: 0, unlimited).
+	                Sizes are in bytes or with a KB, MB or GB suffix.
+	-readtimeout <duration>   Max time to read a request, including uploads
+	                (default: 5m).
+	-writetimeout <duration>  Max time to write a response (default: 5m).
+	-idletimeout <duration>   How long idle keep-alive connections are kept
+	                open (default: 2m).
+	-webhook <url>  POST a json {"event": "publish", "url", "entry"} to url
+	                when an entry is published, including scheduled entries
+	                when their publish time passes.
+
 `
 		fmt.Printf(s)
 		return nil
 	}
 
 	// Exit if db file doesn't exist.
-	dbfile := parms[0]
+	dbfile := cfg.Dbfile
 	if !fileExists(dbfile) {
 		return fmt.Errorf(`Database file '%s' doesn't exist. Create one using:
 	freeblog -i <instance.db>
    `, dbfile)
 	}
 
-	db, err := sql.Open("sqlite3", dbfile)
+	err = applyConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(dbfile)
 	if err != nil {
 		return fmt.Errorf("Error opening '%s' (%s)\n", dbfile, err)
 	}
+	defer db.Close()
+	_, err = migrateDB(db, logWriter{LogInfo}, false)
+	if err != nil {
+		return err
+	}
+	blobs, err = openBlobStore(cfg.Blobs, dbfile)
+	if err != nil {
+		return err
+	}
 
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
+	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(cfg.StaticDir))))
 	http.HandleFunc("/", rootHandler(db))
 	http.HandleFunc("/api/entry/", apientryHandler(db))
+	http.HandleFunc("/api/entry/revisions", apientryrevisionsHandler(db))
+	http.HandleFunc("/api/entry/diff", apientrydiffHandler(db))
+	http.HandleFunc("/api/entry/restore", apientryrestoreHandler(db))
 	http.HandleFunc("/api/entries/", apientriesHandler(db))
+	http.HandleFunc("/api/comments/", apicommentsHandler(db))
+	http.HandleFunc("/api/comments/approve", apimoderatecommentHandler(db, CommentApproved))
+	http.HandleFunc("/api/comments/reject", apimoderatecommentHandler(db, CommentRejected))
 	http.HandleFunc("/api/uploadfiles/", apiuploadfilesHandler(db))
 	http.HandleFunc("/api/file/", apifileHandler(db))
 	http.HandleFunc("/api/files/", apifilesHandler(db))
@@ -141,128 +648,718 @@ func run(args []string) error {
 	http.HandleFunc("/api/deluser/", apideluserHandler(db))
 	http.HandleFunc("/api/login/", apiloginHandler(db))
 	http.HandleFunc("/api/logout/", apilogoutHandler(db))
+	http.HandleFunc("/api/sessions/", apisessionsHandler(db))
+	http.HandleFunc("/api/tokens/", apitokensHandler(db))
+	http.HandleFunc("/api/users/", apiusersHandler(db))
+	http.HandleFunc("/api/userrole/", apiuserroleHandler(db))
+	http.HandleFunc("/api/userquota/", apiuserquotaHandler(db))
+	http.HandleFunc("/api/usage/", apiusageHandler(db))
+	http.HandleFunc("/api/import/", apiimportHandler(db))
+	http.HandleFunc("/api/export", apiexportHandler(db))
+
+	var handler http.Handler = http.DefaultServeMux
+	if hstsMaxAge > 0 {
+		handler = hstsHeaders(handler)
+	}
+	if logLevel <= LogDebug {
+		handler = logRequests(handler)
+	}
+
+	// Publish scheduled entries in the background. It is stopped before
+	// the db is closed.
+	pubctx, stopPublisher := context.WithCancel(context.Background())
+	pubdone := make(chan struct{})
+	go func() {
+		newPublisher(db, clock).run(pubctx)
+		close(pubdone)
+	}()
+	defer func() {
+		stopPublisher()
+		<-pubdone
+	}()
+
+	srvs := []*http.Server{newServer(cfg.Listen, handler)}
+	if cfg.TlsCert != "" {
+		certs, err := newCertReloader(cfg.TlsCert, cfg.TlsKey)
+		if err != nil {
+			return err
+		}
+		certs.reloadOnSignal(syscall.SIGHUP)
+		srvs[0].TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
 
-	port := "8000"
-	if len(parms) > 1 {
-		port = parms[1]
-	}
-	fmt.Printf("Listening on %s...\n", port)
-	err = http.ListenAndServe(fmt.Sprintf(":%s", port), nil)
-	return err
-}
-
-func createTables(newfile string) {
-	if fileExists(newfile) {
-		s := fmt.Sprintf("File '%s' already exists. Can't initialize it.\n", newfile)
-		fmt.Printf(s)
-		os.Exit(1)
+		if cfg.RedirectHttp != "" {
+			srvs = append(srvs, newServer(cfg.RedirectHttp, httpsRedirectHandler(cfg.Listen)))
+		}
 	}
 
-	db, err := sql.Open("sqlite3", newfile)
-	if err != nil {
-		fmt.Printf("Error opening '%s' (%s)\n", newfile, err)
-		os.Exit(1)
-	}
+	// Stop accepting connections on SIGINT/SIGTERM and let in-flight
+	// requests finish before the db is closed.
+	shutdownErr := make(chan error, 1)
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigs
+		logf(LogInfo, "Received %s, shutting down...\n", sig)
 
-	ss := []string{
-		"CREATE TABLE site (site_id INTEGER PRIMARY KEY NOT NULL, title TEXT, about TEXT, isgroup INTEGER);",
-		"CREATE TABLE user (user_id INTEGER PRIMARY KEY NOT NULL, username TEXT UNIQUE, password TEXT);",
-		"CREATE TABLE usersettings (user_id INTEGER PRIMARY KEY NOT NULL, blogtitle TEXT, blogabout TEXT);",
-		"INSERT INTO user (user_id, username, password) VALUES (1, 'admin', '');",
-		"CREATE TABLE entry (entry_id INTEGER PRIMARY KEY NOT NULL, title TEXT, body TEXT, createdt TEXT NOT NULL, user_id INTEGER NOT NULL);",
-		"CREATE TABLE entrytag (entry_id INTEGER NOT NULL, tag TEXT NOT NULL);",
-		"CREATE TABLE file (file_id INTEGER PRIMARY KEY NOT NULL, filename TEXT, title TEXT, bytes BLOB, createdt TEXT NOT NULL, user_id INTEGER NOT NULL);",
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		var err error
+		for _, srv := range srvs {
+			serr := srv.Shutdown(ctx)
+			if serr != nil {
+				err = serr
+			}
+		}
+		shutdownErr <- err
+	}()
+
+	if len(srvs) > 1 {
+		go func() {
+			logf(LogInfo, "Redirecting http on %s to https...\n", srvs[1].Addr)
+			err := srvs[1].ListenAndServe()
+			if err != http.ErrServerClosed {
+				logErr("redirect listener", err)
+			}
+		}()
 	}
 
-	tx, err := db.Begin()
-	if err != nil {
-		log.Printf("DB error (%s)\n", err)
-		os.Exit(1)
+	srv := srvs[0]
+	if srv.TLSConfig != nil {
+		logf(LogInfo, "Listening on %s (https)...\n", srv.Addr)
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		logf(LogInfo, "Listening on %s...\n", srv.Addr)
+		err = srv.ListenAndServe()
 	}
-	for _, s := range ss {
-		_, err := txexec(tx, s)
-		if err != nil {
-			tx.Rollback()
-			log.Printf("DB error (%s)\n", err)
-			os.Exit(1)
-		}
+	if err != http.ErrServerClosed {
+		return err
 	}
-	err = tx.Commit()
+	err = <-shutdownErr
 	if err != nil {
-		log.Printf("DB error (%s)\n", err)
-		os.Exit(1)
+		return fmt.Errorf("Error shutting down (%s)\n", err)
 	}
+	logf(LogInfo, "Shut down.\n")
+	return nil
 }
 
-//*** DB functions ***
-func sqlstmt(db *sql.DB, s string) *sql.Stmt {
-	stmt, err := db.Prepare(s)
-	if err != nil {
-		log.Fatalf("db.Prepare() sql: '%s'\nerror: '%s'", s, err)
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 30 * time.Second,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
 	}
-	return stmt
 }
-func sqlexec(db *sql.DB, s string, pp ...interface{}) (sql.Result, error) {
-	stmt := sqlstmt(db, s)
-	defer stmt.Close()
-	return stmt.Exec(pp...)
+
+// Holds TLS certificate loaded from cert and key files, which are
+// reloaded on SIGHUP so renewed certificates are used without a restart.
+type certReloader struct {
+	certfile string
+	keyfile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
 }
-func txstmt(tx *sql.Tx, s string) *sql.Stmt {
-	stmt, err := tx.Prepare(s)
+
+func newCertReloader(certfile, keyfile string) (*certReloader, error) {
+	cr := &certReloader{certfile: certfile, keyfile: keyfile}
+	err := cr.reload()
 	if err != nil {
-		log.Fatalf("tx.Prepare() sql: '%s'\nerror: '%s'", s, err)
+		return nil, err
 	}
-	return stmt
-}
-func txexec(tx *sql.Tx, s string, pp ...interface{}) (sql.Result, error) {
-	stmt := txstmt(tx, s)
-	defer stmt.Close()
-	return stmt.Exec(pp...)
+	return cr, nil
 }
 
-//*** Helper functions ***
-
-// Helper function to make fmt.Fprintf(w, ...) calls shorter.
-// Ex.
-// Replace:
-//   fmt.Fprintf(w, "<p>Some text %s.</p>", str)
-//   fmt.Fprintf(w, "<p>Some other text %s.</p>", str)
-// with the shorter version:
-//   P := makeFprintf(w)
-//   P("<p>Some text %s.</p>", str)
-//   P("<p>Some other text %s.</p>", str)
-func makeFprintf(w io.Writer) func(format string, a ...interface{}) (n int, err error) {
-	return func(format string, a ...interface{}) (n int, err error) {
-		return fmt.Fprintf(w, format, a...)
+// Loads cert and key files. The current certificate is kept if they can't be loaded.
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certfile, cr.keyfile)
+	if err != nil {
+		return fmt.Errorf("Error loading TLS certificate '%s' and key '%s' (%s)", cr.certfile, cr.keyfile, err)
 	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.mu.Unlock()
+	return nil
 }
-func listContains(ss []string, v string) bool {
-	for _, s := range ss {
-		if v == s {
-			return true
+
+func (cr *certReloader) reloadOnSignal(sig os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	go func() {
+		for range ch {
+			err := cr.reload()
+			if err != nil {
+				logErr("certReloader", err)
+				continue
+			}
+			logf(LogInfo, "Reloaded TLS certificate '%s'\n", cr.certfile)
 		}
-	}
-	return false
+	}()
 }
-func fileExists(file string) bool {
-	_, err := os.Stat(file)
-	if err != nil && os.IsNotExist(err) {
-		return false
-	}
-	return true
+
+// For tls.Config.GetCertificate
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
 }
-func makePrintFunc(w io.Writer) func(format string, a ...interface{}) (n int, err error) {
-	// Return closure enclosing io.Writer.
-	return func(format string, a ...interface{}) (n int, err error) {
-		return fmt.Fprintf(w, format, a...)
-	}
+
+// Redirects http requests to the same url on https. httpsAddr is the https
+// listen address, its port is added to the url unless it's 443.
+func httpsRedirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var target string
+		if strings.HasPrefix(siteBaseUrl, "https://") {
+			target = siteBaseUrl + r.URL.RequestURI()
+		} else {
+			host, _, err := net.SplitHostPort(r.Host)
+			if err != nil {
+				host = r.Host
+			}
+			if port != "" && port != "443" {
+				host = net.JoinHostPort(host, port)
+			}
+			target = fmt.Sprintf("https://%s%s", host, r.URL.RequestURI())
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
 }
-func atoi(s string) int {
-	if s == "" {
-		return 0
+
+// Adds Strict-Transport-Security header to https responses.
+func hstsHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isHttps(r) {
+			w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", int(hstsMaxAge.Seconds())))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns config from defaults, -config file and command line switches.
+// Positional parameters are the db file and port.
+func loadConfig(sw map[string]string, parms []string) (*Config, error) {
+	cfg := Config{
+		Listen:    ":8000",
+		StaticDir: "./static",
+		LogLevel:  "info",
 	}
-	n, err := strconv.Atoi(s)
-	if err != nil {
+	if sw["config"] != "" {
+		bs, err := ioutil.ReadFile(sw["config"])
+		if err != nil {
+			return nil, fmt.Errorf("Error reading config file '%s' (%s)\n", sw["config"], err)
+		}
+		err = json.Unmarshal(bs, &cfg)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing config file '%s' (%s)\n", sw["config"], err)
+		}
+	}
+
+	if len(parms) > 0 {
+		cfg.Dbfile = parms[0]
+	}
+	if len(parms) > 1 {
+		cfg.Listen = ":" + parms[1]
+	}
+	for k, p := range map[string]*string{
+		"listen":       &cfg.Listen,
+		"static":       &cfg.StaticDir,
+		"baseurl":      &cfg.BaseUrl,
+		"tlscert":      &cfg.TlsCert,
+		"tlskey":       &cfg.TlsKey,
+		"redirecthttp": &cfg.RedirectHttp,
+		"hsts":         &cfg.Hsts,
+		"loglevel":     &cfg.LogLevel,
+		"blobs":        &cfg.Blobs,
+		"filecache":    &cfg.FileCache,
+		"maxfilesize":  &cfg.MaxFileSize,
+		"maxupload":    &cfg.MaxUpload,
+		"quota":        &cfg.Quota,
+		"readtimeout":  &cfg.ReadTimeout,
+		"writetimeout": &cfg.WriteTimeout,
+		"idletimeout":  &cfg.IdleTimeout,
+		"webhook":      &cfg.Webhook,
+	} {
+		if sw[k] != "" {
+			*p = sw[k]
+		}
+	}
+	if sw["trustedproxies"] != "" {
+		cfg.TrustedProxies = strings.Split(sw["trustedproxies"], ",")
+	}
+
+	if (cfg.TlsCert == "") != (cfg.TlsKey == "") {
+		return nil, fmt.Errorf("Specify both tlscert and tlskey to serve https.\n")
+	}
+	if cfg.RedirectHttp != "" && cfg.TlsCert == "" {
+		return nil, fmt.Errorf("redirecthttp needs tlscert and tlskey.\n")
+	}
+	return &cfg, nil
+}
+
+// Sets server globals from config.
+func applyConfig(cfg *Config) error {
+	var err error
+
+	logLevel = -1
+	for i, name := range logLevelNames {
+		if strings.ToLower(cfg.LogLevel) == name {
+			logLevel = i
+		}
+	}
+	if logLevel == -1 {
+		return fmt.Errorf("Invalid loglevel '%s'. Use one of %s.\n", cfg.LogLevel, strings.Join(logLevelNames, ", "))
+	}
+
+	siteBaseUrl = strings.TrimSuffix(cfg.BaseUrl, "/")
+	if siteBaseUrl != "" {
+		u, err := url.Parse(siteBaseUrl)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("Invalid baseurl '%s'. Ex. https://blog.example.com\n", cfg.BaseUrl)
+		}
+	}
+
+	webhookUrl = cfg.Webhook
+	if webhookUrl != "" {
+		u, err := url.Parse(webhookUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid webhook '%s'. Ex. https://example.com/hook\n", cfg.Webhook)
+		}
+	}
+
+	trustedProxies = nil
+	for _, sproxy := range cfg.TrustedProxies {
+		sproxy = strings.TrimSpace(sproxy)
+		if sproxy == "" {
+			continue
+		}
+		if !strings.Contains(sproxy, "/") {
+			if strings.Contains(sproxy, ":") {
+				sproxy += "/128"
+			} else {
+				sproxy += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(sproxy)
+		if err != nil {
+			return fmt.Errorf("Invalid trusted proxy '%s' (%s)\n", sproxy, err)
+		}
+		trustedProxies = append(trustedProxies, ipnet)
+	}
+
+	for _, d := range []struct {
+		name string
+		v    string
+		p    *time.Duration
+	}{
+		{"hsts", cfg.Hsts, &hstsMaxAge},
+		{"filecache", cfg.FileCache, &fileCacheMaxAge},
+		{"readtimeout", cfg.ReadTimeout, &serverReadTimeout},
+		{"writetimeout", cfg.WriteTimeout, &serverWriteTimeout},
+		{"idletimeout", cfg.IdleTimeout, &serverIdleTimeout},
+	} {
+		if d.v == "" {
+			continue
+		}
+		*d.p, err = time.ParseDuration(d.v)
+		if err != nil {
+			return fmt.Errorf("Invalid %s duration '%s' (%s)\n", d.name, d.v, err)
+		}
+	}
+	for k, v := range map[string]string{"maxfilesize": cfg.MaxFileSize, "maxupload": cfg.MaxUpload, "quota": cfg.Quota} {
+		if v == "" {
+			continue
+		}
+		n, err := parseByteSize(v)
+		if err != nil {
+			return fmt.Errorf("Invalid %s size '%s' (%s)\n", k, v, err)
+		}
+		switch k {
+		case "maxfilesize":
+			maxFileSize = n
+		case "maxupload":
+			maxUploadSize = n
+		case "quota":
+			userQuota = n
+		}
+	}
+	return nil
+}
+
+func createTables(newfile string) {
+	if fileExists(newfile) {
+		s := fmt.Sprintf("File '%s' already exists. Can't initialize it.\n", newfile)
+		fmt.Printf(s)
+		os.Exit(1)
+	}
+
+	db, err := openDB(newfile)
+	if err != nil {
+		fmt.Printf("Error opening '%s' (%s)\n", newfile, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	_, err = migrateDB(db, io.Discard, false)
+	if err != nil {
+		log.Printf("DB error (%s)\n", err)
+		os.Exit(1)
+	}
+}
+
+//*** Schema migrations ***
+
+// A schema change. Sql statements run in order, then Fn (if any) for data
+// changes that need Go code. Both run in one transaction.
+// ALTER TABLE ... ADD COLUMN statements are skipped if the column already
+// exists, and CREATE statements should use IF NOT EXISTS, so migrations
+// can be applied to databases created before schema_version was tracked.
+type Migration struct {
+	Version int
+	Desc    string
+	Sql     []string
+	Fn      func(tx *sql.Tx) error
+}
+
+// Append new migrations to the end. Never edit a migration once released.
+var migrations = []Migration{
+	{1, "Initial tables", []string{
+		"CREATE TABLE IF NOT EXISTS site (site_id INTEGER PRIMARY KEY NOT NULL, title TEXT, about TEXT, isgroup INTEGER);",
+		"CREATE TABLE IF NOT EXISTS user (user_id INTEGER PRIMARY KEY NOT NULL, username TEXT UNIQUE, password TEXT);",
+		"CREATE TABLE IF NOT EXISTS usersettings (user_id INTEGER PRIMARY KEY NOT NULL, blogtitle TEXT, blogabout TEXT);",
+		"INSERT OR IGNORE INTO user (user_id, username, password) VALUES (1, 'admin', '');",
+		"CREATE TABLE IF NOT EXISTS entry (entry_id INTEGER PRIMARY KEY NOT NULL, title TEXT, body TEXT, createdt TEXT NOT NULL, user_id INTEGER NOT NULL);",
+		"CREATE TABLE IF NOT EXISTS entrytag (entry_id INTEGER NOT NULL, tag TEXT NOT NULL);",
+		"CREATE TABLE IF NOT EXISTS file (file_id INTEGER PRIMARY KEY NOT NULL, filename TEXT, title TEXT, bytes BLOB, createdt TEXT NOT NULL, user_id INTEGER NOT NULL);",
+	}, nil},
+	{2, "Entry status", []string{
+		"ALTER TABLE entry ADD COLUMN status TEXT NOT NULL DEFAULT 'published';",
+		"ALTER TABLE entry ADD COLUMN publishat TEXT;",
+	}, nil},
+	{3, "Entry revisions", []string{
+		"CREATE TABLE IF NOT EXISTS entry_revision (entry_id INTEGER NOT NULL, rev INTEGER NOT NULL, title TEXT, body TEXT, tags TEXT, createdt TEXT NOT NULL, user_id INTEGER NOT NULL, PRIMARY KEY (entry_id, rev));",
+	}, nil},
+	{4, "Full-text entry search", []string{
+		"CREATE VIRTUAL TABLE IF NOT EXISTS entry_fts USING fts5(title, body, tags);",
+		"DELETE FROM entry_fts;",
+		"INSERT INTO entry_fts (rowid, title, body, tags) SELECT e.entry_id, e.title, e.body, IFNULL((SELECT group_concat(tag, ', ') FROM entrytag et WHERE et.entry_id = e.entry_id), '') FROM entry e;",
+	}, nil},
+	{5, "Entry slugs", []string{
+		"ALTER TABLE entry ADD COLUMN slug TEXT;",
+		"CREATE UNIQUE INDEX IF NOT EXISTS entry_slug_idx ON entry (slug);",
+		"CREATE TABLE IF NOT EXISTS entry_slug (slug TEXT PRIMARY KEY NOT NULL, entry_id INTEGER NOT NULL);",
+	}, backfillEntrySlugs},
+	{6, "Comments", []string{
+		"CREATE TABLE IF NOT EXISTS comment (comment_id INTEGER PRIMARY KEY NOT NULL, entry_id INTEGER NOT NULL, parent_id INTEGER NOT NULL DEFAULT 0, user_id INTEGER NOT NULL DEFAULT 0, name TEXT, body TEXT, createdt TEXT NOT NULL, status TEXT NOT NULL DEFAULT 'pending');",
+	}, nil},
+	{7, "Login sessions", []string{
+		"CREATE TABLE IF NOT EXISTS session (session_id INTEGER PRIMARY KEY NOT NULL, token TEXT UNIQUE NOT NULL, user_id INTEGER NOT NULL, createdt TEXT NOT NULL, lastusedt TEXT NOT NULL, expiresat TEXT NOT NULL, useragent TEXT, ip TEXT);",
+	}, nil},
+	{8, "API tokens", []string{
+		"CREATE TABLE IF NOT EXISTS apitoken (token_id INTEGER PRIMARY KEY NOT NULL, token TEXT UNIQUE NOT NULL, user_id INTEGER NOT NULL, name TEXT, scopes TEXT NOT NULL, createdt TEXT NOT NULL, lastusedt TEXT);",
+	}, nil},
+	{9, "User roles", []string{
+		"ALTER TABLE user ADD COLUMN role TEXT NOT NULL DEFAULT 'author';",
+		"UPDATE user SET role = 'admin' WHERE user_id = 1 AND NOT EXISTS (SELECT 1 FROM user WHERE role = 'admin');",
+	}, nil},
+	{10, "File blob store", []string{
+		"ALTER TABLE file ADD COLUMN blobkey TEXT;",
+		"ALTER TABLE file ADD COLUMN size INTEGER NOT NULL DEFAULT 0;",
+		"ALTER TABLE file ADD COLUMN mimetype TEXT NOT NULL DEFAULT '';",
+		"ALTER TABLE file ADD COLUMN width INTEGER NOT NULL DEFAULT 0;",
+		"ALTER TABLE file ADD COLUMN height INTEGER NOT NULL DEFAULT 0;",
+	}, nil},
+	{11, "Image variants", []string{
+		"CREATE TABLE IF NOT EXISTS file_variant (file_id INTEGER NOT NULL, width INTEGER NOT NULL, blobkey TEXT NOT NULL, size INTEGER NOT NULL, mimetype TEXT NOT NULL, PRIMARY KEY (file_id, width));",
+	}, nil},
+	{12, "Site keep photo metadata setting", []string{
+		"ALTER TABLE site ADD COLUMN keepmetadata INTEGER NOT NULL DEFAULT 0;",
+	}, nil},
+	{13, "User storage quota", []string{
+		"ALTER TABLE user ADD COLUMN quota INTEGER NOT NULL DEFAULT 0;",
+	}, nil},
+	{14, "Image variants per format", []string{
+		"CREATE TABLE file_variant_new (file_id INTEGER NOT NULL, width INTEGER NOT NULL, blobkey TEXT NOT NULL, size INTEGER NOT NULL, mimetype TEXT NOT NULL, PRIMARY KEY (file_id, width, mimetype));",
+		"INSERT INTO file_variant_new (file_id, width, blobkey, size, mimetype) SELECT file_id, width, blobkey, size, mimetype FROM file_variant;",
+		"DROP TABLE file_variant;",
+		"ALTER TABLE file_variant_new RENAME TO file_variant;",
+	}, nil},
+	{15, "Publish event outbox", []string{
+		"CREATE TABLE IF NOT EXISTS publish_event (event_id INTEGER PRIMARY KEY NOT NULL, entry_id INTEGER NOT NULL, createdt TEXT NOT NULL);",
+	}, nil},
+}
+
+var addColumnRe = regexp.MustCompile(`(?i)^ALTER TABLE (\w+) ADD COLUMN (\w+)`)
+
+// Implemented by *sql.DB and *sql.Tx
+type sqlQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func tableExists(db sqlQueryer, table string) bool {
+	s := "SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?"
+	var name string
+	err := db.QueryRow(s, table).Scan(&name)
+	return err == nil
+}
+
+func columnExists(db sqlQueryer, table, col string) bool {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, coltype string
+		var dflt sql.NullString
+		rows.Scan(&cid, &name, &coltype, &notnull, &dflt, &pk)
+		if strings.EqualFold(name, col) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the version of the db schema. Databases created before
+// schema_version was added are version 1 (initial tables), 0 if empty.
+func schemaVersion(db sqlQueryer) (int, error) {
+	if !tableExists(db, "schema_version") {
+		if tableExists(db, "site") {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	var version int
+	err := db.QueryRow("SELECT IFNULL(MAX(version), 0) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Returns migration statements that haven't been applied. Adding a column
+// that already exists is skipped.
+func pendingMigrationSql(db sqlQueryer, m *Migration) []string {
+	ss := []string{}
+	for _, s := range m.Sql {
+		match := addColumnRe.FindStringSubmatch(s)
+		if match != nil && columnExists(db, match[1], match[2]) {
+			continue
+		}
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+// Applies migrations newer than the db schema version, each in its own
+// transaction. With dryrun, prints the pending sql to w instead.
+// Returns the number of migrations applied (or pending, with dryrun).
+func migrateDB(db *sql.DB, w io.Writer, dryrun bool) (int, error) {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i := range migrations {
+		m := &migrations[i]
+		if m.Version <= version {
+			continue
+		}
+		n++
+		if dryrun {
+			fmt.Fprintf(w, "-- %d: %s\n", m.Version, m.Desc)
+			for _, s := range pendingMigrationSql(db, m) {
+				fmt.Fprintf(w, "%s\n", s)
+			}
+			if m.Fn != nil {
+				fmt.Fprintf(w, "-- (plus data migration in code)\n")
+			}
+			continue
+		}
+
+		err := applyMigration(db, m)
+		if err != nil {
+			return n - 1, fmt.Errorf("migration %d (%s) failed: %s", m.Version, m.Desc, err)
+		}
+		fmt.Fprintf(w, "Applied migration %d: %s\n", m.Version, m.Desc)
+	}
+	return n, nil
+}
+
+func applyMigration(db *sql.DB, m *Migration) error {
+	return withWriteTx(db, func(tx *sql.Tx) error {
+		ss := append([]string{
+			"CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY NOT NULL, description TEXT, applieddt TEXT NOT NULL);",
+		}, pendingMigrationSql(tx, m)...)
+		for _, s := range ss {
+			_, err := txexec(tx, s)
+			if err != nil {
+				return err
+			}
+		}
+		if m.Fn != nil {
+			err := m.Fn(tx)
+			if err != nil {
+				return err
+			}
+		}
+		s := "INSERT INTO schema_version (version, description, applieddt) VALUES (?, ?, ?)"
+		_, err := txexec(tx, s, m.Version, m.Desc, isodate(time.Now()))
+		return err
+	})
+}
+
+// Gives entries created before slugs a unique slug from their title.
+func backfillEntrySlugs(tx *sql.Tx) error {
+	type entrySlug struct {
+		entryid int64
+		title   string
+	}
+	ee := []entrySlug{}
+	s := "SELECT entry_id, IFNULL(title, '') FROM entry WHERE IFNULL(slug, '') = '' ORDER BY entry_id"
+	rows, err := tx.Query(s)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var e entrySlug
+		rows.Scan(&e.entryid, &e.title)
+		ee = append(ee, e)
+	}
+	rows.Close()
+
+	for _, e := range ee {
+		slug := makeUniqueSlug(tx, e.title, e.entryid)
+		_, err := txexec(tx, "UPDATE entry SET slug = ? WHERE entry_id = ?", slug, e.entryid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//*** DB functions ***
+
+// Opens sqlite db in WAL mode so readers don't block the writer, and waits
+// on a locked db instead of failing with "database is locked".
+func openDB(dbfile string) (*sql.DB, error) {
+	dsn := fmt.Sprintf("%s?_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate", dbfile, dbBusyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// How long a statement waits for the write lock before returning an error.
+var dbBusyTimeout = 10 * time.Second
+
+// Writes are serialized by holding dbWriteMu in sqlexec and withWriteTx, so
+// concurrent requests (ex. parallel uploads) queue for the single sqlite
+// writer instead of contending for the db lock. Reads run concurrently.
+// Write through one of the two, not db.Exec() or db.Begin().
+var dbWriteMu sync.Mutex
+
+func sqlstmt(db *sql.DB, s string) *sql.Stmt {
+	stmt, err := db.Prepare(s)
+	if err != nil {
+		log.Fatalf("db.Prepare() sql: '%s'\nerror: '%s'", s, err)
+	}
+	return stmt
+}
+func sqlexec(db *sql.DB, s string, pp ...interface{}) (sql.Result, error) {
+	dbWriteMu.Lock()
+	defer dbWriteMu.Unlock()
+	stmt := sqlstmt(db, s)
+	defer stmt.Close()
+	return stmt.Exec(pp...)
+}
+func txstmt(tx *sql.Tx, s string) *sql.Stmt {
+	stmt, err := tx.Prepare(s)
+	if err != nil {
+		log.Fatalf("tx.Prepare() sql: '%s'\nerror: '%s'", s, err)
+	}
+	return stmt
+}
+func txexec(tx *sql.Tx, s string, pp ...interface{}) (sql.Result, error) {
+	stmt := txstmt(tx, s)
+	defer stmt.Close()
+	return stmt.Exec(pp...)
+}
+
+// Runs fn in a transaction holding dbWriteMu, committing if fn returns nil
+// and rolling back otherwise. fn must write with txexec, as sqlexec would
+// wait on dbWriteMu forever.
+func withWriteTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	dbWriteMu.Lock()
+	defer dbWriteMu.Unlock()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//*** Helper functions ***
+
+// Helper function to make fmt.Fprintf(w, ...) calls shorter.
+// Ex.
+// Replace:
+//
+//	fmt.Fprintf(w, "<p>Some text %s.</p>", str)
+//	fmt.Fprintf(w, "<p>Some other text %s.</p>", str)
+//
+// with the shorter version:
+//
+//	P := makeFprintf(w)
+//	P("<p>Some text %s.</p>", str)
+//	P("<p>Some other text %s.</p>", str)
+func makeFprintf(w io.Writer) func(format string, a ...interface{}) (n int, err error) {
+	return func(format string, a ...interface{}) (n int, err error) {
+		return fmt.Fprintf(w, format, a...)
+	}
+}
+func listContains(ss []string, v string) bool {
+	for _, s := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+func fileExists(file string) bool {
+	_, err := os.Stat(file)
+	if err != nil && os.IsNotExist(err) {
+		return false
+	}
+	return true
+}
+func makePrintFunc(w io.Writer) func(format string, a ...interface{}) (n int, err error) {
+	// Return closure enclosing io.Writer.
+	return func(format string, a ...interface{}) (n int, err error) {
+		return fmt.Fprintf(w, format, a...)
+	}
+}
+func atoi(s string) int {
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
 		return 0
 	}
 	return n
@@ -327,9 +1424,8 @@ func formatdate(s string) string {
 	return t.Format("2 Jan 2006")
 }
 
-func parseMarkdown(s string) string {
-	s = strings.ReplaceAll(s, "%", "%%")
-	return string(github_flavored_markdown.Markdown([]byte(s)))
+func parseMarkdown(db *sql.DB, s string) string {
+	return addImageSrcsets(db, string(github_flavored_markdown.Markdown([]byte(s))))
 }
 
 func parseArgs(args []string) (map[string]string, []string) {
@@ -337,7 +1433,7 @@ func parseArgs(args []string) (map[string]string, []string) {
 	parms := []string{}
 
 	standaloneSwitches := []string{}
-	definitionSwitches := []string{"i"}
+	definitionSwitches := []string{"i", "moveblobs", "config", "listen", "static", "baseurl", "tlscert", "tlskey", "redirecthttp", "hsts", "loglevel", "trustedproxies", "blobs", "filecache", "maxfilesize", "maxupload", "quota", "readtimeout", "writetimeout", "idletimeout", "webhook", "author"}
 	fNoMoreSwitches := false
 	curKey := ""
 
@@ -348,6 +1444,11 @@ func parseArgs(args []string) (map[string]string, []string) {
 		} else if arg == "--" {
 			// "--" means no more switches to come
 			fNoMoreSwitches = true
+		} else if strings.HasPrefix(arg, "-") && strings.Contains(arg, "=") {
+			// -a=val, --a=val
+			kv := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)
+			switches[kv[0]] = kv[1]
+			curKey = ""
 		} else if strings.HasPrefix(arg, "--") {
 			switches[arg[2:]] = "y"
 			curKey = ""
@@ -400,7 +1501,100 @@ func handleTxErr(tx *sql.Tx, err error) bool {
 	return false
 }
 func logErr(sfunc string, err error) {
-	log.Printf("%s error (%s)\n", sfunc, err)
+	logf(LogError, "%s error (%s)\n", sfunc, err)
+}
+
+// Logs message if level is at or above the -loglevel setting.
+func logf(level int, format string, a ...interface{}) {
+	if level < logLevel {
+		return
+	}
+	log.Printf(format, a...)
+}
+
+// io.Writer that writes each line to the log at level.
+type logWriter struct {
+	level int
+}
+
+func (lw logWriter) Write(p []byte) (int, error) {
+	logf(lw.level, "%s", p)
+	return len(p), nil
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Logs each request, used with -loglevel debug.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := time.Now()
+		sr := &statusRecorder{w, 200}
+		next.ServeHTTP(sr, r)
+		logf(LogDebug, "%s %s %s %d %s\n", clientIp(r), r.Method, r.URL.RequestURI(), sr.status, time.Since(t))
+	})
+}
+
+// Returns true if ip is one of the trusted reverse proxies.
+func isTrustedProxy(ip net.IP) bool {
+	for _, ipnet := range trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIp(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// Returns ip address of client. Requests from trusted proxies use the
+// last X-Forwarded-For address that isn't a trusted proxy itself.
+func clientIp(r *http.Request) string {
+	ip := remoteIp(r)
+	if ip == nil {
+		return r.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip.String()
+	}
+	fwds := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(fwds) - 1; i >= 0; i-- {
+		fwdip := net.ParseIP(strings.TrimSpace(fwds[i]))
+		if fwdip == nil {
+			break
+		}
+		ip = fwdip
+		if !isTrustedProxy(fwdip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// Returns true if client connected through https, directly or through a
+// trusted proxy that sets X-Forwarded-Proto.
+func isHttps(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	ip := remoteIp(r)
+	if ip != nil && isTrustedProxy(ip) {
+		return strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+	}
+	return false
 }
 
 func genHash(sinput string) string {
@@ -422,14 +1616,15 @@ func validateHash(shash, sinput string) bool {
 }
 
 func findSite(db *sql.DB) *Site {
-	s := "SELECT site_id, title, isgroup FROM site WHERE site_id = ?"
+	s := "SELECT site_id, title, isgroup, keepmetadata FROM site WHERE site_id = ?"
 	row := db.QueryRow(s, 1)
 	var site Site
-	err := row.Scan(&site.Siteid, &site.Title, &site.IsGroup)
+	err := row.Scan(&site.Siteid, &site.Title, &site.IsGroup, &site.KeepMetadata)
 	if err != nil {
 		site.Siteid = 1
 		site.Title = "FreeBlog"
 		site.IsGroup = false
+		site.KeepMetadata = false
 	}
 	return &site
 }
@@ -444,8 +1639,8 @@ func findSiteAbout(db *sql.DB) string {
 	return about
 }
 func createSite(db *sql.DB, site *Site) error {
-	s := "INSERT OR REPLACE INTO site (site_id, title, about, isgroup) VALUES (?, ?, ?, ?)"
-	_, err := sqlexec(db, s, 1, site.Title, site.About, site.IsGroup)
+	s := "INSERT OR REPLACE INTO site (site_id, title, about, isgroup, keepmetadata) VALUES (?, ?, ?, ?, ?)"
+	_, err := sqlexec(db, s, 1, site.Title, site.About, site.IsGroup, site.KeepMetadata)
 	return err
 }
 
@@ -477,10 +1672,10 @@ func createUserSettings(db *sql.DB, us *UserSettings) error {
 	return err
 }
 func findUserById(db *sql.DB, userid int64) *User {
-	s := "SELECT user_id, username, password FROM user WHERE user_id = ?"
+	s := "SELECT user_id, username, password, role, quota FROM user WHERE user_id = ?"
 	row := db.QueryRow(s, userid)
 	var u User
-	err := row.Scan(&u.Userid, &u.Username, &u.HashedPwd)
+	err := row.Scan(&u.Userid, &u.Username, &u.HashedPwd, &u.Role, &u.Quota)
 	if err == sql.ErrNoRows {
 		return nil
 	}
@@ -489,11 +1684,24 @@ func findUserById(db *sql.DB, userid int64) *User {
 	}
 	return &u
 }
+
+// Returns the admin with the lowest user id, other than exceptUserid, or
+// nil if there is none.
+func findFirstAdmin(db *sql.DB, exceptUserid int64) *User {
+	s := "SELECT user_id FROM user WHERE role = ? AND user_id <> ? ORDER BY user_id LIMIT 1"
+	row := db.QueryRow(s, RoleAdmin, exceptUserid)
+	var userid int64
+	err := row.Scan(&userid)
+	if err != nil {
+		return nil
+	}
+	return findUserById(db, userid)
+}
 func findUserByUsername(db *sql.DB, username string) *User {
-	s := "SELECT user_id, username, password FROM user WHERE username = ?"
+	s := "SELECT user_id, username, password, role, quota FROM user WHERE username = ?"
 	row := db.QueryRow(s, username)
 	var u User
-	err := row.Scan(&u.Userid, &u.Username, &u.HashedPwd)
+	err := row.Scan(&u.Userid, &u.Username, &u.HashedPwd, &u.Role, &u.Quota)
 	if err == sql.ErrNoRows {
 		return nil
 	}
@@ -502,27 +1710,218 @@ func findUserByUsername(db *sql.DB, username string) *User {
 	}
 	return &u
 }
-func isUsernameExists(db *sql.DB, username string) bool {
+func findUsers(db *sql.DB) ([]*User, error) {
+	s := "SELECT user_id, username, role, quota FROM user ORDER BY user_id"
+	rows, err := db.Query(s)
+	if err != nil {
+		return nil, err
+	}
+	uu := []*User{}
+	for rows.Next() {
+		var u User
+		rows.Scan(&u.Userid, &u.Username, &u.Role, &u.Quota)
+		uu = append(uu, &u)
+	}
+	return uu, nil
+}
+
+// Sets role of user. There must always be at least one admin left.
+func setUserRole(db *sql.DB, userid int64, role string) error {
+	if _, ok := rolePerms[role]; !ok {
+		return fmt.Errorf("Invalid role '%s'", role)
+	}
+	u := findUserById(db, userid)
+	if u == nil {
+		return fmt.Errorf("User not found")
+	}
+	if u.Role == RoleAdmin && role != RoleAdmin {
+		s := "SELECT COUNT(*) FROM user WHERE role = ?"
+		row := db.QueryRow(s, RoleAdmin)
+		var nadmins int
+		err := row.Scan(&nadmins)
+		if err != nil {
+			return err
+		}
+		if nadmins <= 1 {
+			return fmt.Errorf("Can't remove the last admin")
+		}
+	}
+	s := "UPDATE user SET role = ? WHERE user_id = ?"
+	_, err := sqlexec(db, s, role, userid)
+	return err
+}
+
+// Returns true if user's role grants perm.
+func hasPerm(u *User, perm string) bool {
+	if u == nil {
+		return false
+	}
+	return listContains(rolePerms[u.Role], perm)
+}
+func canEditEntry(u *User, e *Entry) bool {
+	if u == nil {
+		return false
+	}
+	return u.Userid == e.Userid || hasPerm(u, PermEditAllEntries)
+}
+func canEditFile(u *User, f *File) bool {
+	if u == nil {
+		return false
+	}
+	return u.Userid == f.Userid || hasPerm(u, PermEditAllFiles)
+}
+
+// Returns true if u can save entry e with its status.
+// Users without publish permission can only save drafts, so their changes
+// never go live without review: saving a published or scheduled entry is
+// refused, and restoring a revision of one turns it back into a draft.
+func canSetEntryStatus(u *User, e *Entry) bool {
+	return e.Status == EntryDraft || hasPerm(u, PermPublish)
+}
+
+func isUsernameExists(db *sql.DB, username string) bool {
 	if findUserByUsername(db, username) == nil {
 		return false
 	}
 	return true
 }
 
-func genSig(u *User) string {
-	sig := genHash(fmt.Sprintf("%s_%s", u.Username, u.HashedPwd))
-	return sig
+// Sessions expire after being unused for sessionIdleTimeout, or after
+// sessionMaxAge since login, whichever comes first.
+var sessionIdleTimeout = 7 * 24 * time.Hour
+var sessionMaxAge = 30 * 24 * time.Hour
+
+// Returns random token suitable for session cookies.
+func genToken() string {
+	bs := make([]byte, 32)
+	_, err := rand.Read(bs)
+	if err != nil {
+		log.Fatalf("genToken() error: '%s'", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+// Tokens are stored hashed so that a leaked db can't be used to log in.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Creates new login session for u and returns the session token.
+func createSession(db *sql.DB, u *User, r *http.Request) (string, *Session, error) {
+	purgeExpiredSessions(db)
+
+	now := time.Now().UTC()
+	token := genToken()
+	var sess Session
+	sess.Userid = u.Userid
+	sess.Createdt = isodate(now)
+	sess.Lastusedt = isodate(now)
+	sess.Expiresat = isodate(now.Add(sessionMaxAge))
+	sess.Useragent = r.UserAgent()
+	sess.Ip = clientIp(r)
+
+	s := "INSERT INTO session (token, user_id, createdt, lastusedt, expiresat, useragent, ip) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	result, err := sqlexec(db, s, hashToken(token), sess.Userid, sess.Createdt, sess.Lastusedt, sess.Expiresat, sess.Useragent, sess.Ip)
+	if err != nil {
+		return "", nil, err
+	}
+	sess.Sessionid, err = result.LastInsertId()
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &sess, nil
+}
+func findSessionByToken(db *sql.DB, token string) *Session {
+	s := "SELECT session_id, user_id, createdt, lastusedt, expiresat, IFNULL(useragent, ''), IFNULL(ip, '') FROM session WHERE token = ?"
+	row := db.QueryRow(s, hashToken(token))
+	var sess Session
+	err := row.Scan(&sess.Sessionid, &sess.Userid, &sess.Createdt, &sess.Lastusedt, &sess.Expiresat, &sess.Useragent, &sess.Ip)
+	if err != nil {
+		return nil
+	}
+	return &sess
+}
+func findUserSessions(db *sql.DB, userid int64) ([]*Session, error) {
+	s := "SELECT session_id, user_id, createdt, lastusedt, expiresat, IFNULL(useragent, ''), IFNULL(ip, '') FROM session WHERE user_id = ? ORDER BY lastusedt DESC"
+	rows, err := db.Query(s, userid)
+	if err != nil {
+		return nil, err
+	}
+	ss := []*Session{}
+	for rows.Next() {
+		var sess Session
+		rows.Scan(&sess.Sessionid, &sess.Userid, &sess.Createdt, &sess.Lastusedt, &sess.Expiresat, &sess.Useragent, &sess.Ip)
+		ss = append(ss, &sess)
+	}
+	return ss, nil
+}
+func isSessionExpired(sess *Session, now time.Time) bool {
+	if now.After(parseisodate(sess.Expiresat)) {
+		return true
+	}
+	if now.Sub(parseisodate(sess.Lastusedt)) > sessionIdleTimeout {
+		return true
+	}
+	return false
+}
+
+// Returns user of session token, or nil if session is invalid or expired.
+func validateSession(db *sql.DB, token string) *User {
+	if token == "" {
+		return nil
+	}
+	sess := findSessionByToken(db, token)
+	if sess == nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	if isSessionExpired(sess, now) {
+		delSession(db, sess.Sessionid)
+		return nil
+	}
+	// Don't write to db on every request, a minute's accuracy is enough.
+	if now.Sub(parseisodate(sess.Lastusedt)) > time.Minute {
+		s := "UPDATE session SET lastusedt = ? WHERE session_id = ?"
+		_, err := sqlexec(db, s, isodate(now), sess.Sessionid)
+		if err != nil {
+			logErr("validateSession", err)
+		}
+	}
+	return findUserById(db, sess.Userid)
+}
+func delSession(db *sql.DB, sessionid int64) error {
+	s := "DELETE FROM session WHERE session_id = ?"
+	_, err := sqlexec(db, s, sessionid)
+	return err
+}
+
+// Deletes all sessions of user except for the session with keepToken.
+func delUserSessions(db *sql.DB, userid int64, keepToken string) error {
+	s := "DELETE FROM session WHERE user_id = ? AND token <> ?"
+	_, err := sqlexec(db, s, userid, hashToken(keepToken))
+	return err
 }
-func validateSig(sig string, u *User) bool {
-	return validateHash(sig, fmt.Sprintf("%s_%s", u.Username, u.HashedPwd))
+func purgeExpiredSessions(db *sql.DB) {
+	now := time.Now().UTC()
+	s := "DELETE FROM session WHERE expiresat < ? OR lastusedt < ?"
+	_, err := sqlexec(db, s, isodate(now), isodate(now.Add(-sessionIdleTimeout)))
+	if err != nil {
+		logErr("purgeExpiredSessions", err)
+	}
 }
 
-func setCookie(w http.ResponseWriter, name, val string) {
+// Cookies are marked Secure when the request came in through https
+// (served with -tlscert, or through a trusted proxy).
+func setCookie(w http.ResponseWriter, r *http.Request, name, val string, httponly bool, expires time.Time) {
 	c := http.Cookie{
-		Name:  name,
-		Value: val,
-		Path:  "/",
-		// Expires: time.Now().Add(24 * time.Hour),
+		Name:     name,
+		Value:    val,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: httponly,
+		Secure:   isHttps(r),
+		SameSite: http.SameSiteLaxMode,
 	}
 	http.SetCookie(w, &c)
 }
@@ -531,7 +1930,7 @@ func delCookie(w http.ResponseWriter, name string) {
 		Name:   name,
 		Value:  "",
 		Path:   "/",
-		MaxAge: 0,
+		MaxAge: -1,
 	}
 	http.SetCookie(w, &c)
 }
@@ -542,113 +1941,215 @@ func readCookie(r *http.Request, name string) string {
 	}
 	return c.Value
 }
-func setLoginCookie(w http.ResponseWriter, u *User, sig string) {
-	setCookie(w, "userid", itoa(u.Userid))
-	setCookie(w, "username", u.Username)
-	setCookie(w, "sig", sig)
+
+// The session token cookie is HttpOnly. The userid, username and role cookies
+// aren't secret, they are read by the dashboard javascript.
+func setLoginCookie(w http.ResponseWriter, r *http.Request, u *User, token string, sess *Session) {
+	expires := parseisodate(sess.Expiresat)
+	setCookie(w, r, "userid", itoa(u.Userid), false, expires)
+	setCookie(w, r, "username", u.Username, false, expires)
+	setCookie(w, r, "role", u.Role, false, expires)
+	setCookie(w, r, "session", token, true, expires)
 }
 func delLoginCookie(w http.ResponseWriter) {
 	delCookie(w, "userid")
 	delCookie(w, "username")
-	delCookie(w, "sig")
-}
-func readLoginCookie(r *http.Request) (*User, string) {
-	var u User
-	u.Userid = idtoi(readCookie(r, "userid"))
-	u.Username = readCookie(r, "username")
-	sig := readCookie(r, "sig")
-	return &u, sig
+	delCookie(w, "role")
+	delCookie(w, "session")
 }
 
-// Reads and validates login cookie. If invalid user/sig, return no user.
+// Reads and validates session cookie. If invalid session, return no user.
 func validateLoginCookie(db *sql.DB, r *http.Request) (*User, string) {
-	utmp, sig := readLoginCookie(r)
-	if utmp.Userid == 0 {
-		return nil, ""
-	}
-	u := findUserById(db, utmp.Userid)
+	token := readCookie(r, "session")
+	u := validateSession(db, token)
 	if u == nil {
 		return nil, ""
 	}
-	if !validateSig(sig, u) {
-		log.Printf("Invalid signature for '%s' ", u.Username)
-		return nil, ""
-	}
-	return u, sig
+	return u, token
 }
 
-// Pass either userid or username (userid takes precedence) and signature to validate.
-func validateUserSig(db *sql.DB, userid int64, username string, sig string) (*User, string) {
-	var u *User
-	if userid != 0 {
-		u = findUserById(db, userid)
-	} else {
-		u = findUserByUsername(db, username)
-	}
-	if u == nil {
-		return nil, ""
+// Returns token from 'Authorization: Bearer <token>' request header.
+func readBearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
 	}
-	if !validateSig(sig, u) {
-		log.Printf("Invalid signature for '%s' ", u.Username)
-		return nil, ""
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+}
+
+// Returns session token of request, from bearer token or session cookie.
+func requestSessionToken(r *http.Request) string {
+	token := readBearerToken(r)
+	if token != "" && !strings.HasPrefix(token, apiTokenPrefix) {
+		return token
 	}
-	return u, sig
+	return readCookie(r, "session")
 }
 
 func validateApiUser(db *sql.DB, r *http.Request) *User {
 	// Get user making the request. There are two ways to specify user:
-	// - Through querystring either userid or username and sig
-	// - Through http cookies 'userid' and 'sig'
-	quserid := idtoi(r.FormValue("userid"))
-	qusername := r.FormValue("username")
-	qsig := r.FormValue("sig")
-
-	var u *User
-	if quserid > 0 || qusername != "" {
-		u, _ = validateUserSig(db, quserid, qusername, qsig)
-	} else {
-		u, _ = validateLoginCookie(db, r)
+	// - Through header 'Authorization: Bearer <token>' containing an api token
+	//   or the session token returned by /api/login
+	// - Through http cookie 'session'
+	token := readBearerToken(r)
+	if strings.HasPrefix(token, apiTokenPrefix) {
+		return validateApiToken(db, token, apiRequestScope(r))
+	}
+	return validateSession(db, requestSessionToken(r))
+}
+
+// Returns the api token scope needed for request.
+// Returns "" for requests that can only be made from a login session.
+func apiRequestScope(r *http.Request) string {
+	if r.Method == "GET" {
+		return ScopeRead
+	}
+	path := r.URL.Path
+	if strings.HasPrefix(path, "/api/entry") || strings.HasPrefix(path, "/api/entries") || strings.HasPrefix(path, "/api/comments") {
+		return ScopeEntriesWrite
+	}
+	if strings.HasPrefix(path, "/api/file") || strings.HasPrefix(path, "/api/uploadfiles") {
+		return ScopeFilesWrite
+	}
+	return ""
+}
+
+func validScope(scope string) bool {
+	return scope == ScopeRead || scope == ScopeEntriesWrite || scope == ScopeFilesWrite
+}
+
+// Returns user of api token if token has scope, nil otherwise.
+// Write scopes include read access.
+func validateApiToken(db *sql.DB, token string, scope string) *User {
+	if scope == "" {
+		return nil
+	}
+	t := findApiTokenByToken(db, token)
+	if t == nil {
+		return nil
+	}
+	tokenScopes := strings.Split(t.Scopes, ",")
+	if scope != ScopeRead && !listContains(tokenScopes, scope) {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(parseisodate(t.Lastusedt)) > time.Minute {
+		s := "UPDATE apitoken SET lastusedt = ? WHERE token_id = ?"
+		_, err := sqlexec(db, s, isodate(now), t.Tokenid)
+		if err != nil {
+			logErr("validateApiToken", err)
+		}
+	}
+	return findUserById(db, t.Userid)
+}
+
+// Creates new api token for user. t.Token is set to the plaintext token
+// which is only available at this point, only its hash is stored.
+func createApiToken(db *sql.DB, t *ApiToken) (int64, error) {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		return 0, fmt.Errorf("Token name required")
+	}
+	var scopes []string
+	for _, scope := range strings.Split(t.Scopes, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if !validScope(scope) {
+			return 0, fmt.Errorf("Invalid scope '%s'", scope)
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return 0, fmt.Errorf("Specify at least one scope (%s, %s or %s)", ScopeRead, ScopeEntriesWrite, ScopeFilesWrite)
+	}
+	t.Scopes = strings.Join(scopes, ",")
+	t.Createdt = isodate(time.Now().UTC())
+	t.Lastusedt = ""
+	t.Token = apiTokenPrefix + genToken()
+
+	s := "INSERT INTO apitoken (token, user_id, name, scopes, createdt, lastusedt) VALUES (?, ?, ?, ?, ?, ?)"
+	result, err := sqlexec(db, s, hashToken(t.Token), t.Userid, t.Name, t.Scopes, t.Createdt, t.Lastusedt)
+	if err != nil {
+		return 0, err
+	}
+	tokenid, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return tokenid, nil
+}
+func findApiTokenByToken(db *sql.DB, token string) *ApiToken {
+	s := "SELECT token_id, user_id, IFNULL(name, ''), scopes, createdt, IFNULL(lastusedt, '') FROM apitoken WHERE token = ?"
+	row := db.QueryRow(s, hashToken(token))
+	var t ApiToken
+	err := row.Scan(&t.Tokenid, &t.Userid, &t.Name, &t.Scopes, &t.Createdt, &t.Lastusedt)
+	if err != nil {
+		return nil
 	}
-	return u
+	return &t
+}
+func findUserApiTokens(db *sql.DB, userid int64) ([]*ApiToken, error) {
+	s := "SELECT token_id, user_id, IFNULL(name, ''), scopes, createdt, IFNULL(lastusedt, '') FROM apitoken WHERE user_id = ? ORDER BY token_id"
+	rows, err := db.Query(s, userid)
+	if err != nil {
+		return nil, err
+	}
+	tt := []*ApiToken{}
+	for rows.Next() {
+		var t ApiToken
+		rows.Scan(&t.Tokenid, &t.Userid, &t.Name, &t.Scopes, &t.Createdt, &t.Lastusedt)
+		tt = append(tt, &t)
+	}
+	return tt, nil
+}
+func delApiToken(db *sql.DB, userid, tokenid int64) error {
+	s := "DELETE FROM apitoken WHERE token_id = ? AND user_id = ?"
+	_, err := sqlexec(db, s, tokenid, userid)
+	return err
 }
 
 var ErrLoginIncorrect = errors.New("Incorrect username or password")
 
-func loginUserid(db *sql.DB, userid int64, pwd string) (*User, string, error) {
+func loginUserid(db *sql.DB, userid int64, pwd string) (*User, error) {
 	u := findUserById(db, userid)
 	if u == nil {
-		return nil, "", ErrLoginIncorrect
+		return nil, ErrLoginIncorrect
 	}
-	sig, err := login(u, pwd)
+	err := login(u, pwd)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-	return u, sig, nil
+	return u, nil
 }
-func loginUsername(db *sql.DB, username, pwd string) (*User, string, error) {
+func loginUsername(db *sql.DB, username, pwd string) (*User, error) {
 	u := findUserByUsername(db, username)
 	if u == nil {
-		return nil, "", ErrLoginIncorrect
+		return nil, ErrLoginIncorrect
 	}
-	sig, err := login(u, pwd)
+	err := login(u, pwd)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-	return u, sig, nil
+	return u, nil
 }
-func login(u *User, pwd string) (string, error) {
+func login(u *User, pwd string) error {
 	if !validateHash(u.HashedPwd, pwd) {
-		return "", ErrLoginIncorrect
+		return ErrLoginIncorrect
 	}
-	// Return user signature, this will be used to authenticate user per request.
-	sig := genSig(u)
-	return sig, nil
+	return nil
 }
 
 func signup(db *sql.DB, username, pwd string) error {
 	if isUsernameExists(db, username) {
 		return fmt.Errorf("username '%s' already exists", username)
 	}
+	// Reserved for /post/my-post entry urls
+	if username == "post" {
+		return fmt.Errorf("username '%s' is not allowed", username)
+	}
 
 	hashedPwd := genHash(pwd)
 	s := "INSERT INTO user (username, password) VALUES (?, ?);"
@@ -659,9 +2160,11 @@ func signup(db *sql.DB, username, pwd string) error {
 	return nil
 }
 
-func edituser(db *sql.DB, userid int64, pwd string, newpwd string) error {
+// Changes user password and logs out all of the user's sessions except for
+// the session with keepToken.
+func edituser(db *sql.DB, userid int64, pwd string, newpwd string, keepToken string) error {
 	// Validate existing password
-	_, _, err := loginUserid(db, userid, pwd)
+	_, err := loginUserid(db, userid, pwd)
 	if err != nil {
 		return err
 	}
@@ -673,12 +2176,16 @@ func edituser(db *sql.DB, userid int64, pwd string, newpwd string) error {
 	if err != nil {
 		return fmt.Errorf("DB error updating user password: %s", err)
 	}
+	err = delUserSessions(db, userid, keepToken)
+	if err != nil {
+		return fmt.Errorf("DB error deleting user sessions: %s", err)
+	}
 	return nil
 }
 
 func deluser(db *sql.DB, userid int64, pwd string) error {
 	// Validate existing password
-	_, _, err := loginUserid(db, userid, pwd)
+	_, err := loginUserid(db, userid, pwd)
 	if err != nil {
 		return err
 	}
@@ -689,6 +2196,15 @@ func deluser(db *sql.DB, userid int64, pwd string) error {
 	if err != nil {
 		return fmt.Errorf("DB error deleting user: %s", err)
 	}
+	err = delUserSessions(db, userid, "")
+	if err != nil {
+		return fmt.Errorf("DB error deleting user sessions: %s", err)
+	}
+	s = "DELETE FROM apitoken WHERE user_id = ?"
+	_, err = sqlexec(db, s, userid)
+	if err != nil {
+		return fmt.Errorf("DB error deleting user api tokens: %s", err)
+	}
 	return nil
 }
 func transferUserEntries(db *sql.DB, fromUserid, toUserid int64) error {
@@ -708,14 +2224,76 @@ func transferUserFiles(db *sql.DB, fromUserid, toUserid int64) error {
 	return nil
 }
 
+// Returns true if entry can be shown to the public.
+// Scheduled entries become public once their publishat time has passed.
+func isEntryPublished(e *Entry, now time.Time) bool {
+	if e.Status == EntryPublished {
+		return true
+	}
+	if e.Status == EntryScheduled {
+		t := parseisodate(e.Publishat)
+		if !t.IsZero() && !t.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if user u can view entry. Unpublished entries are only
+// visible to users who can edit them. Pass nil u for a public visitor.
+func canViewEntry(u *User, e *Entry) bool {
+	if isEntryPublished(e, clock.Now()) {
+		return true
+	}
+	return canEditEntry(u, e)
+}
+
+// Returns sql condition to filter out entries not visible to viewer.
+// Pass nil viewer for public visitors to show only published entries.
+func entryVisibleWhere(viewer *User) (string, []interface{}) {
+	if hasPerm(viewer, PermEditAllEntries) {
+		return "1 = 1", nil
+	}
+	swhere := "(e.status = ? OR (e.status = ? AND e.publishat <= ?)"
+	qq := []interface{}{EntryPublished, EntryScheduled, isodate(clock.Now().UTC())}
+	if viewer != nil {
+		swhere += " OR e.user_id = ?"
+		qq = append(qq, viewer.Userid)
+	}
+	swhere += ")"
+	return swhere, qq
+}
+
+// Checks status and publishat of entry, filling in defaults.
+// Empty status defaults to published, so callers updating an entry should
+// fill in its current status first. Publishat is normalized to UTC.
+func validateEntryStatus(e *Entry) error {
+	if e.Status == "" {
+		e.Status = EntryPublished
+	}
+	if e.Status != EntryDraft && e.Status != EntryPublished && e.Status != EntryScheduled {
+		return fmt.Errorf("Invalid status '%s' (use draft, published or scheduled)", e.Status)
+	}
+	if e.Status != EntryScheduled {
+		e.Publishat = ""
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, e.Publishat)
+	if err != nil {
+		return fmt.Errorf("Scheduled entry needs a valid publishat time (%s)", err)
+	}
+	e.Publishat = isodate(t.UTC())
+	return nil
+}
+
 func findEntry(db *sql.DB, entryid int64) *Entry {
-	s := `SELECT entry_id, title, body, createdt, IFNULL(u.user_id, 0), IFNULL(u.username, '') 
+	s := `SELECT entry_id, title, body, createdt, IFNULL(u.user_id, 0), IFNULL(u.username, ''), e.status, IFNULL(e.publishat, ''), IFNULL(e.slug, '') 
 FROM entry e
 LEFT OUTER JOIN user u ON u.user_id = e.user_id 
 WHERE entry_id = ?`
 	row := db.QueryRow(s, entryid)
 	var e Entry
-	err := row.Scan(&e.Entryid, &e.Title, &e.Body, &e.Createdt, &e.Userid, &e.Username)
+	err := row.Scan(&e.Entryid, &e.Title, &e.Body, &e.Createdt, &e.Userid, &e.Username, &e.Status, &e.Publishat, &e.Slug)
 	if err == sql.ErrNoRows {
 		return nil
 	}
@@ -725,6 +2303,82 @@ WHERE entry_id = ?`
 	e.Tags = findEntryTagsString(db, entryid)
 	return &e
 }
+
+// Returns entry with slug. Old slugs of renamed entries are also looked up.
+func findEntryBySlug(db *sql.DB, slug string) *Entry {
+	s := `SELECT entry_id FROM entry WHERE slug = ? 
+UNION ALL 
+SELECT entry_id FROM entry_slug WHERE slug = ?`
+	row := db.QueryRow(s, slug, slug)
+	var entryid int64
+	err := row.Scan(&entryid)
+	if err != nil {
+		return nil
+	}
+	return findEntry(db, entryid)
+}
+
+// Converts title into a url slug.
+// Ex. "Hello, World! (part 2)" becomes "hello-world-part-2"
+func slugify(title string) string {
+	var sb strings.Builder
+	dash := false
+	for _, ch := range strings.ToLower(title) {
+		if unicode.IsLetter(ch) || unicode.IsDigit(ch) {
+			if dash && sb.Len() > 0 {
+				sb.WriteRune('-')
+			}
+			sb.WriteRune(ch)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	slug := sb.String()
+	if slug == "" {
+		slug = "untitled"
+	}
+	return slug
+}
+
+// Returns true if slug or old slug is used by an entry other than entryid.
+func isSlugTaken(db sqlQueryer, slug string, entryid int64) bool {
+	s := `SELECT entry_id FROM entry WHERE slug = ? AND entry_id <> ? 
+UNION ALL 
+SELECT entry_id FROM entry_slug WHERE slug = ? AND entry_id <> ?`
+	row := db.QueryRow(s, slug, entryid, slug, entryid)
+	var id int64
+	err := row.Scan(&id)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	return true
+}
+
+// If another entry has the same slug, add a -n to make unique.
+// Ex. "my-post", "my-post-2", "my-post-3", etc.
+// If -2 to -99 are all taken, a random suffix is added instead.
+func makeUniqueSlug(db sqlQueryer, slug string, entryid int64) string {
+	slug = slugify(slug)
+	uniqueSlug := slug
+	for i := 2; i < 100; i++ {
+		if !isSlugTaken(db, uniqueSlug, entryid) {
+			return uniqueSlug
+		}
+		uniqueSlug = fmt.Sprintf("%s-%d", slug, i)
+	}
+	// Bounded, as isSlugTaken also reports true on db errors.
+	for i := 0; i < 10; i++ {
+		bs := make([]byte, 6)
+		rand.Read(bs)
+		uniqueSlug = fmt.Sprintf("%s-%s", slug, hex.EncodeToString(bs))
+		if !isSlugTaken(db, uniqueSlug, entryid) {
+			break
+		}
+	}
+	return uniqueSlug
+}
+
 func findEntryTags(db *sql.DB, entryid int64) []string {
 	tt := []string{}
 	s := "SELECT tag FROM entrytag WHERE entry_id = ? ORDER BY tag"
@@ -743,18 +2397,17 @@ func findEntryTagsString(db *sql.DB, entryid int64) string {
 	tt := findEntryTags(db, entryid)
 	return strings.Join(tt, ", ")
 }
-func findEntries(db *sql.DB, quserid int64, qtag string, qlimit, qoffset int) ([]*Entry, error) {
-	sjoin := ""
-	swhere := "1 = 1"
-	var qq []interface{}
 
-	if qtag != "" {
-		sjoin += " INNER JOIN entrytag et ON e.entry_id = et.entry_id AND et.tag = ?"
-		qq = append(qq, qtag)
-	}
-	if quserid != 0 {
-		swhere += " AND u.user_id = ?"
-		qq = append(qq, quserid)
+// Returns entries visible to viewer, optionally filtered by user and tag.
+// Entries are ordered newest first by createdt, so imported entries sort
+// by their original date rather than the order they were added in.
+// Pass nil viewer to return only published entries.
+// Pass qbefore entryid to return only entries after it in that order (for cursor paging).
+func findEntries(db *sql.DB, viewer *User, quserid int64, qtag string, qbefore int64, qlimit, qoffset int) ([]*Entry, error) {
+	sjoin, swhere, qq := entriesWhere(viewer, quserid, qtag)
+	if qbefore != 0 {
+		swhere += " AND (julianday(e.createdt), e.entry_id) < (SELECT julianday(createdt), entry_id FROM entry WHERE entry_id = ?)"
+		qq = append(qq, qbefore)
 	}
 	if qlimit == 0 {
 		// Use an arbitrarily large number to indicate no limit
@@ -762,12 +2415,12 @@ func findEntries(db *sql.DB, quserid int64, qtag string, qlimit, qoffset int) ([
 	}
 	qq = append(qq, qlimit, qoffset)
 
-	s := fmt.Sprintf(`SELECT e.entry_id, e.title, e.body, e.createdt, IFNULL(u.user_id, 0), IFNULL(u.username, '') 
+	s := fmt.Sprintf(`SELECT e.entry_id, e.title, e.body, e.createdt, IFNULL(u.user_id, 0), IFNULL(u.username, ''), e.status, IFNULL(e.publishat, ''), IFNULL(e.slug, '') 
 FROM entry e
 LEFT OUTER JOIN user u ON u.user_id = e.user_id 
  %s 
 WHERE %s 
-ORDER BY e.entry_id DESC 
+ORDER BY julianday(e.createdt) DESC, e.entry_id DESC 
 LIMIT ? OFFSET ?`, sjoin, swhere)
 	rows, err := db.Query(s, qq...)
 	if err != nil {
@@ -776,56 +2429,203 @@ LIMIT ? OFFSET ?`, sjoin, swhere)
 	ee := []*Entry{}
 	for rows.Next() {
 		var e Entry
-		rows.Scan(&e.Entryid, &e.Title, &e.Body, &e.Createdt, &e.Userid, &e.Username)
+		rows.Scan(&e.Entryid, &e.Title, &e.Body, &e.Createdt, &e.Userid, &e.Username, &e.Status, &e.Publishat, &e.Slug)
 		e.Tags = findEntryTagsString(db, e.Entryid)
 		ee = append(ee, &e)
 	}
 	return ee, nil
 }
 
-func findFile(db *sql.DB, fileid int64) *File {
-	s := `SELECT file_id, filename, title, bytes, createdt, IFNULL(u.user_id, 0), IFNULL(u.username, '') 
-FROM file f
-LEFT OUTER JOIN user u ON u.user_id = f.user_id 
-WHERE file_id = ?`
-	row := db.QueryRow(s, fileid)
-	var f File
-	err := row.Scan(&f.Fileid, &f.Filename, &f.Title, &f.Bytes, &f.Createdt, &f.Userid, &f.Username)
-	if err == sql.ErrNoRows {
-		return nil
-	}
-	if err != nil {
-		return nil
-	}
-	return &f
-}
-func findFileByFilename(db *sql.DB, filename string) *File {
-	s := `SELECT file_id, filename, title, bytes, createdt, IFNULL(u.user_id, 0), IFNULL(u.username, '') 
-FROM file f
-LEFT OUTER JOIN user u ON u.user_id = f.user_id 
-WHERE filename = ?`
-	row := db.QueryRow(s, filename)
-	var f File
-	err := row.Scan(&f.Fileid, &f.Filename, &f.Title, &f.Bytes, &f.Createdt, &f.Userid, &f.Username)
-	if err == sql.ErrNoRows {
-		return nil
-	}
+// Returns total number of entries that findEntries() would return without limit.
+func countEntries(db *sql.DB, viewer *User, quserid int64, qtag string) (int, error) {
+	sjoin, swhere, qq := entriesWhere(viewer, quserid, qtag)
+	s := fmt.Sprintf(`SELECT COUNT(*) 
+FROM entry e
+LEFT OUTER JOIN user u ON u.user_id = e.user_id 
+ %s 
+WHERE %s`, sjoin, swhere)
+	row := db.QueryRow(s, qq...)
+	var n int
+	err := row.Scan(&n)
 	if err != nil {
-		return nil
+		return 0, err
 	}
-	return &f
+	return n, nil
 }
-func findFiles(db *sql.DB, quserid int64, qfilename string, qlimit, qoffset int) ([]*File, error) {
-	swhere := "1 = 1"
+
+// Returns join and where sql (and their params) shared by findEntries() and countEntries().
+func entriesWhere(viewer *User, quserid int64, qtag string) (string, string, []interface{}) {
+	sjoin := ""
 	var qq []interface{}
 
+	if qtag != "" {
+		sjoin += " INNER JOIN entrytag et ON e.entry_id = et.entry_id AND et.tag = ?"
+		qq = append(qq, qtag)
+	}
+	swhere, qqvisible := entryVisibleWhere(viewer)
+	qq = append(qq, qqvisible...)
 	if quserid != 0 {
 		swhere += " AND u.user_id = ?"
 		qq = append(qq, quserid)
 	}
-	if qfilename != "" {
-		swhere += " AND filename LIKE ?"
-		qq = append(qq, fmt.Sprintf("%%%s%%", qfilename))
+	return sjoin, swhere, qq
+}
+
+// Converts user search input into an fts5 query where each word is
+// matched as a literal string. Ex. `go "sql` becomes `"go" """sql"`
+func ftsQuery(q string) string {
+	var tt []string
+	for _, w := range strings.Fields(q) {
+		tt = append(tt, fmt.Sprintf("\"%s\"", strings.ReplaceAll(w, "\"", "\"\"")))
+	}
+	return strings.Join(tt, " ")
+}
+
+// Returns entries matching search query q, ordered by relevance.
+// Each entry's Snippet contains html-escaped matching text with the
+// matched words highlighted in <mark> tags.
+func searchEntries(db *sql.DB, viewer *User, quserid int64, q string, qlimit, qoffset int) ([]*Entry, error) {
+	ee := []*Entry{}
+	fq := ftsQuery(q)
+	if fq == "" {
+		return ee, nil
+	}
+
+	swhere, qq := searchEntriesWhere(viewer, quserid, fq)
+	if qlimit == 0 {
+		// Use an arbitrarily large number to indicate no limit
+		qlimit = 10000
+	}
+	qq = append(qq, qlimit, qoffset)
+
+	// Snippet match markers are control chars so that the snippet text
+	// can be escaped before adding the <mark> tags.
+	s := fmt.Sprintf(`SELECT e.entry_id, e.title, e.body, e.createdt, IFNULL(u.user_id, 0), IFNULL(u.username, ''), e.status, IFNULL(e.publishat, ''), IFNULL(e.slug, ''), snippet(entry_fts, -1, char(1), char(2), '...', 16) 
+FROM entry_fts 
+INNER JOIN entry e ON e.entry_id = entry_fts.rowid 
+LEFT OUTER JOIN user u ON u.user_id = e.user_id 
+WHERE entry_fts MATCH ? AND %s 
+ORDER BY rank 
+LIMIT ? OFFSET ?`, swhere)
+	rows, err := db.Query(s, qq...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var e Entry
+		var snippet string
+		rows.Scan(&e.Entryid, &e.Title, &e.Body, &e.Createdt, &e.Userid, &e.Username, &e.Status, &e.Publishat, &e.Slug, &snippet)
+		snippet = escape(snippet)
+		snippet = strings.ReplaceAll(snippet, "\x01", "<mark>")
+		snippet = strings.ReplaceAll(snippet, "\x02", "</mark>")
+		e.Snippet = snippet
+		e.Tags = findEntryTagsString(db, e.Entryid)
+		ee = append(ee, &e)
+	}
+	return ee, nil
+}
+
+// Returns total number of entries matching search query q.
+func countSearchEntries(db *sql.DB, viewer *User, quserid int64, q string) (int, error) {
+	fq := ftsQuery(q)
+	if fq == "" {
+		return 0, nil
+	}
+	swhere, qq := searchEntriesWhere(viewer, quserid, fq)
+	s := fmt.Sprintf(`SELECT COUNT(*) 
+FROM entry_fts 
+INNER JOIN entry e ON e.entry_id = entry_fts.rowid 
+LEFT OUTER JOIN user u ON u.user_id = e.user_id 
+WHERE entry_fts MATCH ? AND %s`, swhere)
+	row := db.QueryRow(s, qq...)
+	var n int
+	err := row.Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+func searchEntriesWhere(viewer *User, quserid int64, fq string) (string, []interface{}) {
+	swhere, qqvisible := entryVisibleWhere(viewer)
+	qq := []interface{}{fq}
+	qq = append(qq, qqvisible...)
+	if quserid != 0 {
+		swhere += " AND u.user_id = ?"
+		qq = append(qq, quserid)
+	}
+	return swhere, qq
+}
+
+// Updates the search index for entry.
+func indexEntry(tx *sql.Tx, e *Entry) error {
+	err := unindexEntry(tx, e.Entryid)
+	if err != nil {
+		return err
+	}
+	s := "INSERT INTO entry_fts (rowid, title, body, tags) VALUES (?, ?, ?, ?)"
+	_, err = txexec(tx, s, e.Entryid, e.Title, e.Body, e.Tags)
+	return err
+}
+func unindexEntry(tx *sql.Tx, entryid int64) error {
+	s := "DELETE FROM entry_fts WHERE rowid = ?"
+	_, err := txexec(tx, s, entryid)
+	return err
+}
+
+// Rebuilds the search index from all entries.
+func reindexEntries(db *sql.DB) error {
+	_, err := sqlexec(db, "DELETE FROM entry_fts")
+	if err != nil {
+		return err
+	}
+	s := "INSERT INTO entry_fts (rowid, title, body, tags) SELECT e.entry_id, e.title, e.body, IFNULL((SELECT group_concat(tag, ', ') FROM entrytag et WHERE et.entry_id = e.entry_id), '') FROM entry e"
+	_, err = sqlexec(db, s)
+	return err
+}
+
+func findFile(db *sql.DB, fileid int64) *File {
+	s := `SELECT file_id, filename, title, IFNULL(blobkey, ''), size, mimetype, width, height, createdt, IFNULL(u.user_id, 0), IFNULL(u.username, '') 
+FROM file f
+LEFT OUTER JOIN user u ON u.user_id = f.user_id 
+WHERE file_id = ?`
+	row := db.QueryRow(s, fileid)
+	var f File
+	err := row.Scan(&f.Fileid, &f.Filename, &f.Title, &f.Blobkey, &f.Size, &f.Mimetype, &f.Width, &f.Height, &f.Createdt, &f.Userid, &f.Username)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	return &f
+}
+func findFileByFilename(db *sql.DB, filename string) *File {
+	s := `SELECT file_id, filename, title, IFNULL(blobkey, ''), size, mimetype, width, height, createdt, IFNULL(u.user_id, 0), IFNULL(u.username, '') 
+FROM file f
+LEFT OUTER JOIN user u ON u.user_id = f.user_id 
+WHERE filename = ?`
+	row := db.QueryRow(s, filename)
+	var f File
+	err := row.Scan(&f.Fileid, &f.Filename, &f.Title, &f.Blobkey, &f.Size, &f.Mimetype, &f.Width, &f.Height, &f.Createdt, &f.Userid, &f.Username)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	return &f
+}
+func findFiles(db *sql.DB, quserid int64, qfilename string, qlimit, qoffset int) ([]*File, error) {
+	swhere := "1 = 1"
+	var qq []interface{}
+
+	if quserid != 0 {
+		swhere += " AND u.user_id = ?"
+		qq = append(qq, quserid)
+	}
+	if qfilename != "" {
+		swhere += " AND filename LIKE ?"
+		qq = append(qq, fmt.Sprintf("%%%s%%", qfilename))
 	}
 	if qlimit == 0 {
 		// Use an arbitrarily large number to indicate no limit
@@ -878,7 +2678,7 @@ func findAttachmentFiles(db *sql.DB, quserid int64, qfilename string, qlimit, qo
 	return findFilesWithParams(db, swhere, qq)
 }
 func findFilesWithParams(db *sql.DB, swhere string, qq []interface{}) ([]*File, error) {
-	s := fmt.Sprintf(`SELECT file_id, filename, title, createdt, IFNULL(u.user_id, 0), IFNULL(u.username, '') 
+	s := fmt.Sprintf(`SELECT file_id, filename, title, size, mimetype, width, height, createdt, IFNULL(u.user_id, 0), IFNULL(u.username, '') 
 FROM file f
 LEFT OUTER JOIN user u ON u.user_id = f.user_id 
 WHERE %s 
@@ -891,1303 +2691,5931 @@ LIMIT ? OFFSET ?`, swhere)
 	ff := []*File{}
 	for rows.Next() {
 		var f File
-		rows.Scan(&f.Fileid, &f.Filename, &f.Title, &f.Createdt, &f.Userid, &f.Username)
+		rows.Scan(&f.Fileid, &f.Filename, &f.Title, &f.Size, &f.Mimetype, &f.Width, &f.Height, &f.Createdt, &f.Userid, &f.Username)
 		f.Url = fileurl(&f)
 		ff = append(ff, &f)
 	}
 	return ff, nil
 }
 
-//*** HTML template functions ***
-func printHtmlOpen(P PrintFunc, title string, jsurls []string) {
-	P("<!DOCTYPE html>\n")
-	P("<html>\n")
-	P("<head>\n")
-	P("<meta charset=\"utf-8\">\n")
-	P("<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">\n")
-	P("<title>%s</title>\n", title)
-	P("<link rel=\"stylesheet\" type=\"text/css\" href=\"/static/style.css\">\n")
-	for _, jsurl := range jsurls {
-		P("<script defer src=\"%s\"></script>\n", jsurl)
+//*** Blob storage ***
+
+// File contents are kept in a blob store outside the database.
+// Blobs are content-addressed: the key is the sha256 hex digest of the
+// contents, so identical uploads share one blob.
+type BlobStore interface {
+	Put(key string, bs []byte) error
+	Open(key string) (io.ReadSeekCloser, error)
+	Delete(key string) error
+}
+
+// Blob store set by -blobs switch.
+var blobs BlobStore
+
+// How long browsers and proxies may cache served files before
+// revalidating them, set by -filecache switch. Zero means always revalidate.
+var fileCacheMaxAge = 24 * time.Hour
+
+// Multipart uploads are kept in memory up to this size, the rest is
+// buffered to temp files.
+const maxUploadMemory = 32 << 20
+
+// Upload limits in bytes, set by -maxfilesize, -maxupload and -quota switches.
+// userQuota is the default storage quota per user, 0 for unlimited.
+// A user's own quota setting (user.quota) overrides it.
+var maxFileSize int64 = 32 << 20
+var maxUploadSize int64 = 128 << 20
+var userQuota int64 = 0
+
+var ErrQuotaExceeded = errors.New("Storage quota exceeded")
+
+// Returns blob store from -blobs switch value.
+// Ex. "/var/freeblog/blobs" or "s3://mybucket?endpoint=http://localhost:9000&region=us-east-1"
+// Empty spec uses a directory next to the db file.
+func openBlobStore(spec string, dbfile string) (BlobStore, error) {
+	if spec == "" {
+		spec = dbfile + ".blobs"
 	}
-	P("<style>\n")
-	P(".myfont {font-family: Helvetica Neue,Helvetica,Arial,sans-serif;}\n")
-	P("</style>\n")
-	P("</head>\n")
-	P("<body class=\"text-base leading-6 myfont dark\">\n")
+	if !strings.HasPrefix(spec, "s3://") {
+		return &LocalBlobStore{Dir: strings.TrimPrefix(spec, "file://")}, nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid blob store '%s' (%s)", spec, err)
+	}
+	endpoint := u.Query().Get("endpoint")
+	if endpoint == "" {
+		return nil, fmt.Errorf("Blob store '%s' needs an endpoint parameter", spec)
+	}
+	region := u.Query().Get("region")
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3BlobStore{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Bucket:    u.Host,
+		Region:    region,
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Client:    &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+func blobKey(bs []byte) string {
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:])
+}
+
+// Upload pipeline for new file contents in f.Bytes: detects mime type,
+// strips photo metadata unless the site keeps it, then stores the result.
+// Sets f.Mimetype, f.Width, f.Height, f.Blobkey and f.Size.
+// Call the returned release func once the file row is saved.
+func putFileContents(db *sql.DB, f *File) (func(), error) {
+	f.Mimetype = detectMimetype(f.Filename, f.Bytes)
+	if !findSite(db).KeepMetadata {
+		f.Bytes = stripPhotoMetadata(f.Bytes, f.Mimetype)
+	}
+	f.Width, f.Height = imageSize(f.Bytes)
+	f.Blobkey = blobKey(f.Bytes)
+	f.Size = int64(len(f.Bytes))
+	return putPendingBlob(f.Blobkey, f.Bytes)
+}
+
+// Blob keys stored for rows that aren't saved yet, guarded by blobMu.
+// An upload of contents already in the store skips writing the blob, so
+// without this delUnusedBlob could delete it between the upload's Put and
+// its insert, leaving the new row pointing at a missing blob.
+var blobMu sync.Mutex
+var pendingBlobs = map[string]int{}
+
+// Stores blob that a file or variant row is about to refer to. delUnusedBlob
+// keeps it until the returned release func is called, which should be done
+// after the row is saved or has failed to save.
+func putPendingBlob(key string, bs []byte) (func(), error) {
+	blobMu.Lock()
+	pendingBlobs[key]++
+	blobMu.Unlock()
+	release := func() {
+		blobMu.Lock()
+		pendingBlobs[key]--
+		if pendingBlobs[key] <= 0 {
+			delete(pendingBlobs, key)
+		}
+		blobMu.Unlock()
+	}
+	err := blobs.Put(key, bs)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
 }
-func printHtmlClose(P PrintFunc) {
-	P("</body>\n")
-	P("</html>\n")
+
+// Returns reader for file contents. Files uploaded before the blob store
+// was introduced are read from the file.bytes column.
+func openFileContents(db *sql.DB, f *File) (io.ReadSeekCloser, error) {
+	if f.Blobkey != "" {
+		return blobs.Open(f.Blobkey)
+	}
+	s := "SELECT bytes FROM file WHERE file_id = ?"
+	row := db.QueryRow(s, f.Fileid)
+	var bs []byte
+	err := row.Scan(&bs)
+	if err != nil {
+		return nil, err
+	}
+	return nopSeekCloser{bytes.NewReader(bs)}, nil
 }
-func printContainerOpen(P PrintFunc) {
-	P("<div id=\"container\" class=\"flex flex-col py-2 mx-auto max-w-screen-sm\">\n")
+
+type nopSeekCloser struct {
+	io.ReadSeeker
 }
-func printWideContainerOpen(P PrintFunc) {
-	P("<div id=\"container\" class=\"flex flex-col py-2 mx-auto max-w-screen-lg\">\n")
+
+func (nopSeekCloser) Close() error {
+	return nil
 }
-func printContainerHscreenOpen(P PrintFunc) {
-	P("<div id=\"container\" class=\"flex flex-col py-2 mx-auto max-w-screen-sm h-screen\">\n")
+
+// Deletes blob if no file refers to it anymore, and no upload is about to.
+func delUnusedBlob(db *sql.DB, key string) error {
+	if key == "" {
+		return nil
+	}
+	blobMu.Lock()
+	defer blobMu.Unlock()
+	if pendingBlobs[key] > 0 {
+		return nil
+	}
+	s := "SELECT (SELECT COUNT(*) FROM file WHERE blobkey = ?) + (SELECT COUNT(*) FROM file_variant WHERE blobkey = ?)"
+	row := db.QueryRow(s, key, key)
+	var n int
+	err := row.Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	return blobs.Delete(key)
+}
+
+// Returns size from string like "512KB", "32MB", "1GB" or "1048576".
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			mult = unit.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size")
+	}
+	return n * mult, nil
 }
-func printContainerClose(P PrintFunc) {
-	P("</div>\n")
+
+// Returns total size of files owned by user. Files not moved out of the
+// db yet are counted by the length of file.bytes.
+func userStorageUsed(db sqlQueryer, userid int64) (int64, error) {
+	s := "SELECT IFNULL(SUM(size + IFNULL(LENGTH(bytes), 0)), 0) FROM file WHERE user_id = ?"
+	row := db.QueryRow(s, userid)
+	var used int64
+	err := row.Scan(&used)
+	return used, err
 }
-func printHeading(P PrintFunc, u *User, pp *PageParams) {
-	P("<div class=\"flex flex-row justify-between border-b border-gray-500 pb-1 mb-4 text-sm\"\n>")
-	P("    <div>\n")
-	P("        <h1 class=\"inline self-end ml-1 mr-2 font-bold\"><a href=\"%s\">%s</a></h1>\n", pp.BaseUrl, pp.BlogTitle)
-	P("        <a href=\"%s?page=about\" class=\"self-end mr-2\">About</a>\n", pp.BaseUrl)
-	P("        <a href=\"%s?page=tags\" class=\"self-end mr-2\">Tags</a>\n", pp.BaseUrl)
-	P("    </div>\n")
-	P("    <div>\n")
-	if u != nil {
-		P("        <div class=\"relative inline mr-2\">\n")
-		P("            <a class=\"mr-1\" href=\"%s?page=dashboard\">%s</a>\n", pp.BaseUrl, escape(u.Username))
-		P("        </div>\n")
-		P("        <a href=\"%s?page=logout\" class=\"inline self-end mr-1\">Logout</a>\n", pp.BaseUrl)
-	} else {
-		P("        <a href=\"%s?page=login\" class=\"inline self-end mr-1\">Login</a>\n", pp.BaseUrl)
+
+// Returns storage quota of user, 0 for unlimited.
+func userStorageQuota(u *User) int64 {
+	if u.Quota > 0 {
+		return u.Quota
 	}
-	P("    </div>\n")
-	P("</div>\n")
+	return userQuota
 }
-func printFormOpen(P PrintFunc, action, heading string) {
-	P("<form action=\"%s\" method=\"post\" class=\"flex-grow flex flex-col panel mx-auto py-2 px-8 text-sm w-full\">\n", action)
-	if heading != "" {
-		P("    <h1 class=\"font-bold mx-auto mb-2 text-center text-base\">%s</h1>\n", heading)
+
+// Returns ErrQuotaExceeded if adding addsize bytes to user's files would
+// go over their quota. createFile and editFile check it in the transaction
+// that saves the file, so parallel uploads can't all pass the check.
+func checkStorageQuota(db sqlQueryer, userid int64, addsize int64) error {
+	var u User
+	s := "SELECT quota FROM user WHERE user_id = ?"
+	err := db.QueryRow(s, userid).Scan(&u.Quota)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	quota := userStorageQuota(&u)
+	if quota == 0 {
+		return nil
 	}
+	used, err := userStorageUsed(db, userid)
+	if err != nil {
+		return err
+	}
+	if used+addsize > quota {
+		return ErrQuotaExceeded
+	}
+	return nil
 }
-func printFormSmallOpen(P PrintFunc, action, heading string) {
-	P("<form action=\"%s\" method=\"post\" class=\"flex-grow flex flex-col panel mx-auto py-2 px-8 text-sm max-w-sm\">\n", action)
-	if heading != "" {
-		P("    <h1 class=\"font-bold mx-auto mb-2 text-center text-base\">%s</h1>\n", heading)
+
+// Returns true if err is from reading past an http.MaxBytesReader limit.
+func isMaxBytesError(err error) bool {
+	var maxerr *http.MaxBytesError
+	return errors.As(err, &maxerr)
+}
+
+// Moves contents of file.bytes column into store. Returns number of files moved.
+// Files are moved one at a time so large databases don't need to fit in memory.
+func moveBlobs(db *sql.DB, store BlobStore) (int, error) {
+	s := "SELECT file_id FROM file WHERE IFNULL(blobkey, '') = '' AND bytes IS NOT NULL ORDER BY file_id"
+	rows, err := db.Query(s)
+	if err != nil {
+		return 0, err
+	}
+	var fileids []int64
+	for rows.Next() {
+		var fileid int64
+		rows.Scan(&fileid)
+		fileids = append(fileids, fileid)
+	}
+	rows.Close()
+
+	for i, fileid := range fileids {
+		s := "SELECT filename, bytes FROM file WHERE file_id = ?"
+		row := db.QueryRow(s, fileid)
+		var filename string
+		var bs []byte
+		err := row.Scan(&filename, &bs)
+		if err != nil {
+			return i, err
+		}
+		key := blobKey(bs)
+		err = store.Put(key, bs)
+		if err != nil {
+			return i, err
+		}
+		width, height := imageSize(bs)
+		s = "UPDATE file SET blobkey = ?, size = ?, mimetype = ?, width = ?, height = ?, bytes = NULL WHERE file_id = ?"
+		_, err = sqlexec(db, s, key, len(bs), detectMimetype(filename, bs), width, height, fileid)
+		if err != nil {
+			return i, err
+		}
+	}
+
+	// Reclaim the space used by the moved blobs.
+	if len(fileids) > 0 {
+		_, err = sqlexec(db, "VACUUM")
+		if err != nil {
+			return len(fileids), err
+		}
 	}
+	return len(fileids), nil
 }
-func printFormClose(P PrintFunc) {
-	P("</form>\n")
+
+// Stores blobs in a local directory, two levels deep by key prefix.
+// Ex. <dir>/ab/cd/abcd1234...
+type LocalBlobStore struct {
+	Dir string
 }
-func printFormInput(P PrintFunc, id, label, val string) {
-	P("<div class=\"mb-2\">\n")
-	P("    <label class=\"block font-bold uppercase text-xs\" for=\"%s\">%s</label>\n", id, label)
-	P("    <input class=\"block border border-gray-500 py-1 px-4 w-full\" id=\"%[1]s\" name=\"%[1]s\" type=\"text\" value=\"%s\">\n", id, val)
-	P("</div>\n")
+
+func (st *LocalBlobStore) path(key string) string {
+	return filepath.Join(st.Dir, key[0:2], key[2:4], key)
 }
-func printFormInputPassword(P PrintFunc, id, label, val string) {
-	P("<div class=\"mb-2\">\n")
-	P("    <label class=\"block font-bold uppercase text-xs\" for=\"%s\">%s</label>\n", id, label)
-	P("    <input class=\"block border border-gray-500 py-1 px-4 w-full\" id=\"%[1]s\" name=\"%[1]s\" type=\"password\" value=\"%s\">\n", id, val)
-	P("</div>\n")
+func (st *LocalBlobStore) Put(key string, bs []byte) error {
+	p := st.path(key)
+	if fileExists(p) {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	// Write to temp file first so readers never see a partial blob.
+	tmp, err := ioutil.TempFile(filepath.Dir(p), key+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(bs)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
 }
-func printFormTextarea(P PrintFunc, id, label, val string) {
-	P("<div class=\"flex-grow flex flex-col mb-2\">\n")
-	P("    <label class=\"block font-bold uppercase text-xs\" for=\"%s\">%s</label>\n", id, label)
-	P("    <textarea class=\"flex-grow block border border-gray-500 py-1 px-4 w-full leading-5\" id=\"%[1]s\" name=\"%[1]s\">%s</textarea>\n", id, val)
-	P("</div>\n")
+func (st *LocalBlobStore) Open(key string) (io.ReadSeekCloser, error) {
+	return os.Open(st.path(key))
 }
-func printFormError(P PrintFunc, errmsg string) {
-	if errmsg == "" {
-		return
+func (st *LocalBlobStore) Delete(key string) error {
+	err := os.Remove(st.path(key))
+	if os.IsNotExist(err) {
+		return nil
 	}
-	P("<div class=\"mb-2\">\n")
-	P("    <p class=\"font-bold uppercase text-xs\">%s</p>\n", errmsg)
-	P("</div>\n")
+	return err
 }
-func printFormSubmit(P PrintFunc, caption string) {
-	P("<div class=\"mb-2\">\n")
-	P("    <button type=\"submit\" class=\"inline w-full mx-auto py-1 px-2 border border-gray-500 font-bold mr-2\">%s</button>\n", caption)
-	P("</div>\n")
+
+// Stores blobs in an S3-compatible bucket (AWS S3, MinIO, etc.) using
+// path-style urls: <endpoint>/<bucket>/<key>
+type S3BlobStore struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
 }
 
-// Ex. printFormLinks(P, "justify-end", "/signup", "Sign Up", "/login", "Login")
-func printFormLinks(P PrintFunc, justify string, ss ...string) {
-	type Link struct {
-		Href    string
-		Caption string
-	}
-
-	if justify == "" {
-		justify = "justify-between"
-	}
-
-	var ll []Link
-	var l Link
-	for _, s := range ss {
-		if l.Href == "" {
-			l.Href = s
-			continue
-		}
-		if l.Caption == "" {
-			l.Caption = s
-			ll = append(ll, l)
-
-			l.Href = ""
-			l.Caption = ""
-		}
-
+func (st *S3BlobStore) do(method, key string, bs []byte, hdr map[string]string) (*http.Response, error) {
+	surl := fmt.Sprintf("%s/%s/%s", st.Endpoint, st.Bucket, key)
+	req, err := http.NewRequest(method, surl, bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
 	}
-
-	P("<div class=\"flex flex-row %s\">\n", justify)
-	for _, l := range ll {
-		P("    <a class=\"text-xs\" href=\"%s\">%s</a>\n", l.Href, l.Caption)
+	req.ContentLength = int64(len(bs))
+	for k, v := range hdr {
+		req.Header.Set(k, v)
 	}
-	P("</div>\n")
+	signS3Request(req, bs, st.Region, st.AccessKey, st.SecretKey, time.Now().UTC())
+	return st.Client.Do(req)
 }
-func printDivOpen(P PrintFunc, heading string) {
-	P("<div class=\"panel mx-auto py-4 px-8 text-sm\">\n")
-	if heading != "" {
-		P("    <h1 class=\"font-bold mx-auto mb-2 text-center text-base\">%s</h1>\n", heading)
+func (st *S3BlobStore) Put(key string, bs []byte) error {
+	res, err := st.do("PUT", key, bs, nil)
+	if err != nil {
+		return err
 	}
-}
-func printDivSmallOpen(P PrintFunc, heading string) {
-	P("<div class=\"panel mx-auto py-4 px-8 text-sm max-w-sm\">\n")
-	if heading != "" {
-		P("    <h1 class=\"font-bold mb-2 text-base\">%s</h1>\n", heading)
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return s3Error(res)
 	}
+	return nil
 }
-func printDivFlex(P PrintFunc, justify string) {
-	P("<div class=\"flex flex-row %s\">\n", justify)
-}
-func printDivClose(P PrintFunc) {
-	P("</div>\n")
+func (st *S3BlobStore) Open(key string) (io.ReadSeekCloser, error) {
+	return &s3Object{st: st, key: key, size: -1}, nil
 }
-
-func rootHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		page := r.FormValue("page")
-		if page == "index" || page == "" {
-			indexHandler(w, r, db)
-		} else if page == "about" {
-			aboutHandler(w, r, db)
-		} else if page == "tags" {
-			tagsHandler(w, r, db)
-		} else if page == "entry" {
-			entryHandler(w, r, db)
-		} else if page == "file" {
-			fileHandler(w, r, db)
-		} else if page == "login" {
-			loginHandler(w, r, db)
-		} else if page == "logout" {
-			logoutHandler(w, r, db)
-		} else if page == "signup" {
-			signupHandler(w, r, db)
-		} else if page == "dashboard" {
-			dashboardHandler(w, r, db)
-		}
+func (st *S3BlobStore) Delete(key string) error {
+	res, err := st.do("DELETE", key, nil, nil)
+	if err != nil {
+		return err
 	}
-}
-
-func parsePageUrl(r *http.Request) (string, string) {
-	surl := strings.Trim(r.URL.Path, "/")
-	ss := strings.Split(surl, "/")
-	sslen := len(ss)
-	if sslen == 0 {
-		return "", ""
-	} else if sslen == 1 {
-		return qunescape(ss[0]), ""
+	defer res.Body.Close()
+	if res.StatusCode != 200 && res.StatusCode != 204 && res.StatusCode != 404 {
+		return s3Error(res)
 	}
-	return qunescape(ss[0]), qunescape(ss[1])
+	return nil
 }
-func getPageParams(r *http.Request, db *sql.DB) *PageParams {
-	var pp PageParams
 
-	site := findSite(db)
-	pp.IsGroup = site.IsGroup
-	pp.BlogTitle = site.Title
-	pp.BaseUrl = "/"
+// Reads an S3 object from the current offset with ranged GETs, so seeking
+// (ex. for http range requests) doesn't download the whole object.
+type s3Object struct {
+	st   *S3BlobStore
+	key  string
+	size int64
+	off  int64
+	body io.ReadCloser
+}
 
-	blogusername, _ := parsePageUrl(r)
-	if blogusername == "" {
-		return &pp
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.body == nil {
+		if o.size >= 0 && o.off >= o.size {
+			return 0, io.EOF
+		}
+		hdr := map[string]string{"Range": fmt.Sprintf("bytes=%d-", o.off)}
+		res, err := o.st.do("GET", o.key, nil, hdr)
+		if err != nil {
+			return 0, err
+		}
+		if res.StatusCode == 416 {
+			res.Body.Close()
+			return 0, io.EOF
+		}
+		if res.StatusCode != 200 && res.StatusCode != 206 {
+			defer res.Body.Close()
+			return 0, s3Error(res)
+		}
+		if res.StatusCode == 200 && o.off > 0 {
+			// Server ignored range, skip to offset.
+			_, err = io.CopyN(ioutil.Discard, res.Body, o.off)
+			if err != nil {
+				res.Body.Close()
+				return 0, err
+			}
+		}
+		o.body = res.Body
+	}
+	n, err := o.body.Read(p)
+	o.off += int64(n)
+	return n, err
+}
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.off
+	case io.SeekEnd:
+		if o.size < 0 {
+			res, err := o.st.do("HEAD", o.key, nil, nil)
+			if err != nil {
+				return 0, err
+			}
+			res.Body.Close()
+			if res.StatusCode != 200 {
+				return 0, s3Error(res)
+			}
+			o.size = res.ContentLength
+		}
+		offset += o.size
+	default:
+		return 0, fmt.Errorf("s3Object.Seek: invalid whence")
 	}
-	u := findUserByUsername(db, blogusername)
-	if u == nil {
-		return &pp
+	if offset < 0 {
+		return 0, fmt.Errorf("s3Object.Seek: negative position")
 	}
-	pp.BlogUserid = u.Userid
-	pp.BlogUsername = u.Username
-
-	if site.IsGroup {
-		return &pp
+	if offset != o.off && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.off = offset
+	return offset, nil
+}
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
 	}
+	return o.body.Close()
+}
 
-	// user blog space Ex. /user123
-	// Use usersettings title and make /user123 the base url
-	us := findUserSettingsById(db, u.Userid)
-	pp.BlogTitle = escape(us.BlogTitle)
-	pp.BaseUrl = fmt.Sprintf("/%s", blogusername)
-	return &pp
+func s3Error(res *http.Response) error {
+	bs, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("S3 %s %s: %s %s", res.Request.Method, res.Request.URL.Path, res.Status, strings.TrimSpace(string(bs)))
 }
-func indexHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	u, _ := validateLoginCookie(db, r)
 
-	pp := getPageParams(r, db)
-	qtag := r.FormValue("tag")
-	ee, err := findEntries(db, pp.BlogUserid, qtag, 0, 0)
-	if handleDbErr(w, err, "indexHandler") {
-		return
-	}
+// Signs request using AWS Signature Version 4. Host and all headers set on
+// req are signed.
+func signS3Request(req *http.Request, payload []byte, region, accessKey, secretKey string, t time.Time) {
+	amzdate := t.Format("20060102T150405Z")
+	datestamp := t.Format("20060102")
+	payloadHash := blobKey(payload)
 
-	w.Header().Set("Content-Type", "text/html")
-	P := makeFprintf(w)
-	printHtmlOpen(P, pp.BlogTitle, nil)
-	printContainerOpen(P)
-	printHeading(P, u, pp)
+	req.Header.Set("x-amz-date", amzdate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
 
-	title := "Latest Posts"
-	if pp.IsGroup && pp.BlogUsername != "" {
-		title += fmt.Sprintf(" from %s", escape(pp.BlogUsername))
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
 	}
-	if qtag != "" {
-		title += fmt.Sprintf(" tagged '%s'", escape(qtag))
+	hdrs := map[string]string{"host": host}
+	for k, vv := range req.Header {
+		k = strings.ToLower(k)
+		if k == "authorization" {
+			continue
+		}
+		hdrs[k] = strings.Join(strings.Fields(strings.Join(vv, ",")), " ")
+	}
+	names := []string{}
+	for k := range hdrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, hdrs[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	uri := req.URL.Path
+	if uri == "" {
+		uri = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsUriEncode(uri, false),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", datestamp, region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzdate,
+		scope,
+		blobKey([]byte(canonicalRequest)),
+	}, "\n")
+
+	hmacsha256 := func(key []byte, s string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(s))
+		return h.Sum(nil)
+	}
+	k := hmacsha256([]byte("AWS4"+secretKey), datestamp)
+	k = hmacsha256(k, region)
+	k = hmacsha256(k, "s3")
+	k = hmacsha256(k, "aws4_request")
+	signature := hex.EncodeToString(hmacsha256(k, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// Percent-encodes s the way SigV4 canonical requests expect: all bytes
+// except unreserved characters, and "/" unless encodeSlash.
+func awsUriEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			sb.WriteByte(b)
+			continue
+		}
+		fmt.Fprintf(&sb, "%%%02X", b)
 	}
+	return sb.String()
+}
 
-	P("<h1 class=\"font-bold text-lg mb-2\">%s</h1>\n", title)
-	for _, e := range ee {
-		P("<div class=\"flex flex-row py-1\">\n")
-		P("    <p class=\"text-xs text-gray-700\">%s</p>\n", formatdate(e.Createdt))
-		P("    <p class=\"flex-grow px-4\">\n")
-		P("        <a class=\"action font-bold\" href=\"%s?page=entry&id=%d\">%s</a>\n", pp.BaseUrl, e.Entryid, escape(e.Title))
-		P("    </p>\n")
-		if pp.IsGroup || pp.BlogUserid == 0 {
-			P("    <a class=\"text-xs text-gray-700 px-2\" href=\"/%s\">%s</a>\n", qescape(e.Username), escape(e.Username))
+// Returns query parameters sorted and encoded for a SigV4 canonical request.
+// Ex. "max-keys=2&prefix=J"
+func awsCanonicalQuery(q url.Values) string {
+	type param struct{ k, v string }
+	params := []param{}
+	for k, vv := range q {
+		for _, v := range vv {
+			params = append(params, param{awsUriEncode(k, true), awsUriEncode(v, true)})
 		}
-		P("</div>\n")
 	}
-
-	printContainerClose(P)
-	printHtmlClose(P)
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].k != params[j].k {
+			return params[i].k < params[j].k
+		}
+		return params[i].v < params[j].v
+	})
+	ss := []string{}
+	for _, p := range params {
+		ss = append(ss, p.k+"="+p.v)
+	}
+	return strings.Join(ss, "&")
 }
 
-func tagsHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	u, _ := validateLoginCookie(db, r)
+//*** Image variants ***
 
-	pp := getPageParams(r, db)
+// Widths of resized image variants. Requested widths are rounded up to one of these.
+var imageVariantWidths = []int{160, 320, 640, 1280}
 
-	w.Header().Set("Content-Type", "text/html")
-	P := makeFprintf(w)
-	printHtmlOpen(P, pp.BlogTitle, nil)
-	printContainerOpen(P)
-	printHeading(P, u, pp)
+// Images larger than this many pixels aren't resized, to limit memory use.
+// Decoding and resizing one takes about 5 bytes per pixel.
+const maxResizePixels = 25 * 1000 * 1000
 
-	P("<h1 class=\"font-bold text-lg mb-2\">Tags</h1>\n")
-	P("<div class=\"flex flex-col py-1\">\n")
+// Limits how many images are decoded and resized at once.
+var resizeSem = make(chan struct{}, 2)
 
-	swhere := "1 = 1"
-	var qq []interface{}
+// Variants being generated, so that concurrent requests for the same one
+// wait for it instead of resizing the image again. Guarded by variantMu.
+var variantMu sync.Mutex
+var variantCalls = map[string]*variantCall{}
 
-	if pp.BlogUserid != 0 {
-		swhere += " AND e.user_id = ?"
-		qq = append(qq, pp.BlogUserid)
-	}
+type variantCall struct {
+	done chan struct{}
+	v    *ImageVariant
+	err  error
+}
 
-	s := fmt.Sprintf(`SELECT DISTINCT et.tag, (SELECT COUNT(*) FROM entrytag et2 WHERE et2.tag = et.tag) AS numentries 
-FROM entrytag et 
-INNER JOIN entry e ON et.entry_id = e.entry_id 
-WHERE %s 
-ORDER BY numentries DESC`, swhere)
-	rows, err := db.Query(s, qq...)
-	if handleDbErr(w, err, "tagsHandler") {
-		return
+// Returns width and height of image contents, or 0, 0 if not an image.
+func imageSize(bs []byte) (int, int) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(bs))
+	if err != nil {
+		return 0, 0
 	}
-	for rows.Next() {
-		var tag string
-		var numentries int
-		rows.Scan(&tag, &numentries)
-		P("<p>\n")
-		P("  <a class=\"action mr-1\" href=\"%s?tag=%s\">%s</a>\n", pp.BaseUrl, qescape(tag), escape(tag))
-		P("  <span class=\"text-sm\">(%d)</span>\n", numentries)
-		P("</p>\n")
+	return cfg.Width, cfg.Height
+}
+
+// Returns true for image types that can be decoded and resized.
+// There is no TIFF codec, so those are served as is.
+func isResizableImage(mimetype string) bool {
+	switch mimetype {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
 	}
-	P("</div>\n")
+	return false
+}
 
-	printContainerClose(P)
-	printHtmlClose(P)
+// Returns variant width to use for requested width qw of image that is
+// origw wide. Returns 0 if the original should be served instead.
+func imageVariantWidth(qw, origw int) int {
+	w := imageVariantWidths[len(imageVariantWidths)-1]
+	for _, vw := range imageVariantWidths {
+		if vw >= qw {
+			w = vw
+			break
+		}
+	}
+	if origw > 0 && w >= origw {
+		return 0
+	}
+	return w
 }
 
-func aboutHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	u, _ := validateLoginCookie(db, r)
+func findImageVariant(db *sql.DB, fileid int64, width int, mimetype string) *ImageVariant {
+	s := "SELECT file_id, width, blobkey, size, mimetype FROM file_variant WHERE file_id = ? AND width = ? AND mimetype = ?"
+	row := db.QueryRow(s, fileid, width, mimetype)
+	var v ImageVariant
+	err := row.Scan(&v.Fileid, &v.Width, &v.Blobkey, &v.Size, &v.Mimetype)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
 
-	w.Header().Set("Content-Type", "text/html")
-	P := makeFprintf(w)
-	pp := getPageParams(r, db)
-	printHtmlOpen(P, pp.BlogTitle, nil)
-	printContainerOpen(P)
-	printHeading(P, u, pp)
+// Returns mime type of resized variants of image with mimetype.
+// Variants are webp for clients that accept it. Otherwise jpegs stay jpeg,
+// and other images become png to keep transparency.
+func imageVariantMimetype(mimetype string, acceptWebp bool) string {
+	if acceptWebp {
+		return "image/webp"
+	}
+	if mimetype == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
 
-	var aboutBody string
-	if pp.BlogUserid == 0 {
-		aboutBody = findSiteAbout(db)
-	} else {
-		aboutBody = findUserAboutById(db, pp.BlogUserid)
+// Returns resized variant of image file closest to width qw, generating and
+// caching it in the blob store on first request.
+// Returns nil variant if the original image should be served.
+func findOrCreateImageVariant(db *sql.DB, f *File, qw int, acceptWebp bool) (*ImageVariant, error) {
+	width := imageVariantWidth(qw, f.Width)
+	if width == 0 {
+		return nil, nil
+	}
+	mimetype := imageVariantMimetype(f.Mimetype, acceptWebp)
+	v := findImageVariant(db, f.Fileid, width, mimetype)
+	if v != nil {
+		return v, nil
 	}
 
-	P("<div class=\"content\">\n")
-	P("%s\n", parseMarkdown(aboutBody))
-	P("</div>\n")
+	key := fmt.Sprintf("%d/%d/%s", f.Fileid, width, mimetype)
+	variantMu.Lock()
+	c := variantCalls[key]
+	if c != nil {
+		variantMu.Unlock()
+		<-c.done
+		return c.v, c.err
+	}
+	c = &variantCall{done: make(chan struct{})}
+	variantCalls[key] = c
+	variantMu.Unlock()
 
-	printContainerClose(P)
-	printHtmlClose(P)
+	c.v, c.err = createImageVariant(db, f, qw, width, mimetype)
+	variantMu.Lock()
+	delete(variantCalls, key)
+	variantMu.Unlock()
+	close(c.done)
+	return c.v, c.err
 }
 
-func entryHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	u, _ := validateLoginCookie(db, r)
+// Decodes, resizes and stores a variant of image file f. At most
+// cap(resizeSem) run at once.
+func createImageVariant(db *sql.DB, f *File, qw, width int, mimetype string) (*ImageVariant, error) {
+	resizeSem <- struct{}{}
+	defer func() { <-resizeSem }()
 
-	qid := idtoi(r.FormValue("id"))
-	if qid == 0 {
-		http.Error(w, "Not found.", 404)
-		return
+	rc, err := openFileContents(db, f)
+	if err != nil {
+		return nil, err
 	}
-	e := findEntry(db, qid)
-	if e == nil {
-		http.Error(w, "Not found.", 404)
-		return
+	defer rc.Close()
+	bs, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	origw, origh := imageSize(bs)
+	if origw == 0 || origw*origh > maxResizePixels {
+		return nil, nil
+	}
+	if f.Width != origw || f.Height != origh {
+		// Files uploaded before image sizes were stored.
+		s := "UPDATE file SET width = ?, height = ? WHERE file_id = ?"
+		_, err = sqlexec(db, s, origw, origh, f.Fileid)
+		if err != nil {
+			return nil, err
+		}
+		if imageVariantWidth(qw, origw) == 0 {
+			return nil, nil
+		}
 	}
 
-	w.Header().Set("Content-Type", "text/html")
-	P := makeFprintf(w)
-	pp := getPageParams(r, db)
-	printHtmlOpen(P, pp.BlogTitle, nil)
-	printContainerOpen(P)
-	printHeading(P, u, pp)
-
-	printEntry(P, db, e, pp)
-
-	printContainerClose(P)
-	printHtmlClose(P)
-}
-func printEntry(P PrintFunc, db *sql.DB, e *Entry, pp *PageParams) {
-	P("<h1 class=\"font-bold text-2xl mb-2\">%s</h1>\n", escape(e.Title))
-	if e.Username != "" {
-		P("<p class=\"mb-4 text-sm\">Posted on \n")
-		P("    <span class=\"italic\">%s</span> by \n", formatdate(e.Createdt))
-		P("    <a href=\"/%s\" class=\"action\">%s</a>\n", qescape(e.Username), escape(e.Username))
-		P("</p>\n")
-	} else {
-		P("<p class=\"mb-4 text-sm\">Posted on <span class=\"italic\">%s</span></p>\n", formatdate(e.Createdt))
+	img, _, err := image.Decode(bytes.NewReader(bs))
+	if err != nil {
+		return nil, nil
 	}
-	P("<div class=\"content\">\n")
-	P("%s\n", parseMarkdown(e.Body))
-	P("</div>\n")
-
-	printTags(P, e.Tags, pp)
-}
-func printTags(P PrintFunc, tags string, pp *PageParams) {
-	if tags == "" {
-		return
+	height := origh * width / origw
+	if height < 1 {
+		height = 1
 	}
+	dst := resizeImage(img, width, height)
 
-	P("<p class=\"mt-4 italic text-sm\">Tags: \n")
-	tt := strings.Split(tags, ",")
-	for i, t := range tt {
-		t = strings.TrimSpace(t)
-		if t == "" {
-			continue
-		}
-		P("    <a href=\"%s?tag=%s\" class=\"italic action\">%s</a>", pp.BaseUrl, qescape(t), escape(t))
-		if i < len(tt)-1 {
-			P(", ")
-		}
+	var buf bytes.Buffer
+	v := &ImageVariant{Fileid: f.Fileid, Width: width, Mimetype: mimetype}
+	switch mimetype {
+	case "image/webp":
+		err = webp.Encode(&buf, dst, &webp.Options{Quality: 80})
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	default:
+		err = png.Encode(&buf, dst)
 	}
-	P("</p>\n")
-}
-
-func fileext(filename string) string {
-	ss := strings.Split(filename, ".")
-	if len(ss) < 2 {
-		return ""
+	if err != nil {
+		return nil, err
+	}
+	vbs := buf.Bytes()
+	v.Blobkey = blobKey(vbs)
+	v.Size = int64(len(vbs))
+	release, err := putPendingBlob(v.Blobkey, vbs)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	s := "INSERT OR REPLACE INTO file_variant (file_id, width, blobkey, size, mimetype) VALUES (?, ?, ?, ?, ?)"
+	_, err = sqlexec(db, s, v.Fileid, v.Width, v.Blobkey, v.Size, v.Mimetype)
+	if err != nil {
+		return nil, err
 	}
-	return strings.ToLower(ss[len(ss)-1])
+	return v, nil
 }
 
-// GET /?page=file&id=123
-// GET /?page=file&filename=file1.jpg
-func fileHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	qid := idtoi(r.FormValue("id"))
-	qfilename := r.FormValue("filename")
-	if qid == 0 && qfilename == "" {
-		http.Error(w, "Specify id or filename (id=nnn or filename=file1.jpg)", 401)
-		return
-	}
-	var f *File
-	if qid > 0 {
-		f = findFile(db, qid)
-	} else if qfilename != "" {
-		f = findFileByFilename(db, qfilename)
+// Deletes cached variants of image file.
+func delImageVariants(db *sql.DB, fileid int64) error {
+	s := "SELECT blobkey FROM file_variant WHERE file_id = ?"
+	rows, err := db.Query(s, fileid)
+	if err != nil {
+		return err
 	}
-	if f == nil {
-		http.Error(w, "Not found.", 404)
-		return
+	var keys []string
+	for rows.Next() {
+		var key string
+		rows.Scan(&key)
+		keys = append(keys, key)
 	}
+	rows.Close()
 
-	ext := fileext(f.Filename)
-	if ext == "" {
-		w.Header().Set("Content-Type", "application")
-	} else if ext == "png" || ext == "gif" || ext == "bmp" {
-		w.Header().Set("Content-Type", fmt.Sprintf("image/%s", ext))
-	} else if ext == "jpg" || ext == "jpeg" {
-		w.Header().Set("Content-Type", fmt.Sprintf("image/jpeg"))
-	} else {
-		w.Header().Set("Content-Type", fmt.Sprintf("application/%s", ext))
-	}
-	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", f.Filename))
-	_, err := w.Write(f.Bytes)
+	s = "DELETE FROM file_variant WHERE file_id = ?"
+	_, err = sqlexec(db, s, fileid)
 	if err != nil {
-		log.Printf("Error writing file '%s' (%s)\n", f.Filename, err)
+		return err
+	}
+	for _, key := range keys {
+		err := delUnusedBlob(db, key)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func loginHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	u, _ := validateLoginCookie(db, r)
-	pp := getPageParams(r, db)
-
-	var errmsg string
-	var f struct{ username, pwd string }
-
-	if r.Method == "POST" {
-		f.username = r.FormValue("username")
-		f.pwd = r.FormValue("pwd")
-		for {
-			u, sig, err := loginUsername(db, f.username, f.pwd)
-			if err != nil {
-				errmsg = fmt.Sprintf("%s", err)
-				break
+// Scales down image to width x height by averaging each block of source
+// pixels (box filter), which gives smooth results when shrinking.
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	sb := src.Bounds()
+	srgba := image.NewRGBA(image.Rect(0, 0, sb.Dx(), sb.Dy()))
+	draw.Draw(srgba, srgba.Bounds(), src, sb.Min, draw.Src)
+	sw, sh := sb.Dx(), sb.Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for dy := 0; dy < height; dy++ {
+		sy0 := dy * sh / height
+		sy1 := (dy + 1) * sh / height
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for dx := 0; dx < width; dx++ {
+			sx0 := dx * sw / width
+			sx1 := (dx + 1) * sw / width
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
 			}
-			setLoginCookie(w, u, sig)
-
-			http.Redirect(w, r, fmt.Sprintf("/%s", qescape(u.Username)), http.StatusSeeOther)
-			return
+			var r, g, b, a, n uint32
+			for sy := sy0; sy < sy1; sy++ {
+				i := srgba.PixOffset(sx0, sy)
+				for sx := sx0; sx < sx1; sx++ {
+					r += uint32(srgba.Pix[i])
+					g += uint32(srgba.Pix[i+1])
+					b += uint32(srgba.Pix[i+2])
+					a += uint32(srgba.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+			j := dst.PixOffset(dx, dy)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
 		}
 	}
-
-	w.Header().Set("Content-Type", "text/html")
-	P := makeFprintf(w)
-	printHtmlOpen(P, pp.BlogTitle, nil)
-	printContainerOpen(P)
-	printHeading(P, u, pp)
-
-	printFormSmallOpen(P, fmt.Sprintf("%s?page=login", pp.BaseUrl), "Log In")
-	printFormInput(P, "username", "username", f.username)
-	printFormInputPassword(P, "pwd", "password", f.pwd)
-	printFormError(P, errmsg)
-	printFormSubmit(P, "Login")
-	printFormLinks(P, "", fmt.Sprintf("%s?page=signup", pp.BaseUrl), "Create New Account", "/", "Cancel")
-	printFormClose(P)
-
-	printContainerClose(P)
-	printHtmlClose(P)
-}
-func logoutHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	delLoginCookie(w)
-
-	pp := getPageParams(r, db)
-	http.Redirect(w, r, fmt.Sprintf("%s", pp.BaseUrl), http.StatusSeeOther)
+	return dst
 }
-func signupHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	u, _ := validateLoginCookie(db, r)
-	pp := getPageParams(r, db)
 
-	var errmsg string
-	var f struct{ username, pwd, pwd2 string }
+var imgTagRe = regexp.MustCompile(`<img\s[^>]*>`)
+var imgFileSrcRe = regexp.MustCompile(`\ssrc="(/\?page=file&(?:amp;)?id=(\d+))"`)
 
-	if r.Method == "POST" {
-		f.username = r.FormValue("username")
-		f.pwd = r.FormValue("pwd")
-		f.pwd2 = r.FormValue("pwd2")
-		for {
-			if f.pwd != f.pwd2 {
-				errmsg = "passwords don't match"
-				break
-			}
-			err := signup(db, f.username, f.pwd)
-			if err != nil {
-				errmsg = fmt.Sprintf("%s", err)
-				break
-			}
-			u, sig, err := loginUsername(db, f.username, f.pwd)
-			if err != nil {
-				errmsg = fmt.Sprintf("%s", err)
+// Adds srcset and sizes attributes to <img> tags of images hosted by
+// this blog, so browsers can pick a resized variant.
+// Ex. <img src="/?page=file&id=12" srcset="/?page=file&id=12&w=320 320w, ...">
+func addImageSrcsets(db *sql.DB, s string) string {
+	return imgTagRe.ReplaceAllStringFunc(s, func(tag string) string {
+		if strings.Contains(tag, "srcset=") {
+			return tag
+		}
+		m := imgFileSrcRe.FindStringSubmatch(tag)
+		if m == nil {
+			return tag
+		}
+		f := findFile(db, idtoi(m[2]))
+		if f == nil || f.Width == 0 || !isResizableImage(f.Mimetype) {
+			return tag
+		}
+		src := m[1]
+		var ss []string
+		for _, vw := range imageVariantWidths {
+			if vw >= f.Width {
 				break
 			}
-			setLoginCookie(w, u, sig)
-
-			http.Redirect(w, r, fmt.Sprintf("/%s", qescape(u.Username)), http.StatusSeeOther)
-			return
+			ss = append(ss, fmt.Sprintf("%s&amp;w=%d %dw", src, vw, vw))
 		}
+		if len(ss) == 0 {
+			return tag
+		}
+		ss = append(ss, fmt.Sprintf("%s %dw", src, f.Width))
+		attrs := fmt.Sprintf(` srcset="%s" sizes="(max-width: %dpx) 100vw, %dpx"`, strings.Join(ss, ", "), f.Width, f.Width)
+		return strings.Replace(tag, m[0], m[0]+attrs, 1)
+	})
+}
+
+//*** Photo metadata ***
+
+// Returns photo contents without EXIF, XMP, IPTC and comment metadata,
+// which can hold GPS location and camera details. Images with an EXIF
+// orientation are rotated first so they still display upright.
+// Contents that can't be parsed are returned unchanged.
+func stripPhotoMetadata(bs []byte, mimetype string) []byte {
+	var stripped []byte
+	var err error
+	switch mimetype {
+	case "image/jpeg":
+		stripped, err = stripJpegMetadata(bs)
+	case "image/png":
+		stripped, err = stripPngMetadata(bs)
+	default:
+		return bs
 	}
+	if err != nil {
+		log.Printf("stripPhotoMetadata: keeping original (%s)\n", err)
+		return bs
+	}
+	return stripped
+}
+
+// JPEG markers
+const (
+	jpegSOI   = 0xd8
+	jpegSOS   = 0xda
+	jpegAPP0  = 0xe0 // JFIF
+	jpegAPP1  = 0xe1 // EXIF, XMP
+	jpegAPP2  = 0xe2 // ICC color profile
+	jpegAPP14 = 0xee // Adobe
+	jpegAPP15 = 0xef
+	jpegCOM   = 0xfe
+)
 
-	w.Header().Set("Content-Type", "text/html")
-	P := makeFprintf(w)
-	printHtmlOpen(P, pp.BlogTitle, nil)
-	printContainerOpen(P)
-	printHeading(P, u, pp)
+// Removes APP1 (EXIF, XMP), APP13 (Photoshop, IPTC), other vendor APPn
+// segments and comments from jpeg.
+// JFIF (APP0), ICC profile (APP2) and Adobe (APP14) segments are kept since
+// they affect how colors are decoded.
+func stripJpegMetadata(bs []byte) ([]byte, error) {
+	if len(bs) < 4 || bs[0] != 0xff || bs[1] != jpegSOI {
+		return nil, fmt.Errorf("not a jpeg")
+	}
+	orientation := 1
+	var icc [][]byte
+	var out bytes.Buffer
+	out.Write(bs[0:2])
+
+	i := 2
+	for {
+		if i+4 > len(bs) || bs[i] != 0xff {
+			return nil, fmt.Errorf("invalid jpeg segment at %d", i)
+		}
+		marker := bs[i+1]
+		if marker == 0xff {
+			// fill byte
+			i++
+			continue
+		}
+		if marker == jpegSOS {
+			// Compressed image data follows, copy the rest as is.
+			out.Write(bs[i:])
+			break
+		}
+		seglen := int(binary.BigEndian.Uint16(bs[i+2 : i+4]))
+		end := i + 2 + seglen
+		if seglen < 2 || end > len(bs) {
+			return nil, fmt.Errorf("invalid jpeg segment length at %d", i)
+		}
+		seg := bs[i:end]
+		data := bs[i+4 : end]
 
-	printFormSmallOpen(P, fmt.Sprintf("%s?page=signup", pp.BaseUrl), "Sign Up")
-	printFormInput(P, "username", "username", f.username)
-	printFormInputPassword(P, "pwd", "password", f.pwd)
-	printFormInputPassword(P, "pwd2", "re-enter password", f.pwd2)
-	printFormError(P, errmsg)
-	printFormSubmit(P, "Sign Up")
-	printFormLinks(P, "justify-end", "/", "Cancel")
-	printFormClose(P)
+		switch {
+		case marker == jpegAPP1:
+			if bytes.HasPrefix(data, []byte("Exif\x00\x00")) {
+				orientation = exifOrientation(data[6:])
+			}
+		case marker == jpegAPP2:
+			out.Write(seg)
+			icc = append(icc, seg)
+		case marker == jpegAPP0 || marker == jpegAPP14:
+			out.Write(seg)
+		case marker >= jpegAPP0 && marker <= jpegAPP15, marker == jpegCOM:
+			// other app segments and comments
+		default:
+			out.Write(seg)
+		}
+		i = end
+	}
 
-	printContainerClose(P)
-	printHtmlClose(P)
-}
+	if orientation == 1 {
+		return out.Bytes(), nil
+	}
 
-func createEntry(db *sql.DB, e *Entry) (int64, error) {
-	s := "INSERT INTO entry (title, body, createdt, user_id) VALUES (?, ?, ?, ?)"
-	result, err := sqlexec(db, s, e.Title, e.Body, e.Createdt, e.Userid)
+	// Apply orientation to pixels, since the orientation tag is gone.
+	img, err := jpeg.Decode(bytes.NewReader(out.Bytes()))
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	entryid, err := result.LastInsertId()
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, orientImage(img, orientation), &jpeg.Options{Quality: 92})
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	err = setEntryTags(db, entryid, e.Tags)
-	if err != nil {
-		return entryid, err
+	// Put back color profile after SOI.
+	rotated := buf.Bytes()
+	out.Reset()
+	out.Write(rotated[0:2])
+	for _, seg := range icc {
+		out.Write(seg)
 	}
-	return entryid, nil
+	out.Write(rotated[2:])
+	return out.Bytes(), nil
 }
-func editEntry(db *sql.DB, e *Entry) error {
-	s := "UPDATE entry SET title = ?, body = ? WHERE entry_id = ?"
-	_, err := sqlexec(db, s, e.Title, e.Body, e.Entryid)
-	if err != nil {
-		return err
+
+// Removes eXIf, text (tEXt, zTXt, iTXt incl. XMP) and tIME chunks from png.
+func stripPngMetadata(bs []byte) ([]byte, error) {
+	sig := []byte("\x89PNG\r\n\x1a\n")
+	if !bytes.HasPrefix(bs, sig) {
+		return nil, fmt.Errorf("not a png")
 	}
-	err = setEntryTags(db, e.Entryid, e.Tags)
-	if err != nil {
-		return err
+	orientation := 1
+	var out bytes.Buffer
+	out.Write(sig)
+
+	i := len(sig)
+	for i < len(bs) {
+		if i+12 > len(bs) {
+			return nil, fmt.Errorf("invalid png chunk at %d", i)
+		}
+		chunklen := int(binary.BigEndian.Uint32(bs[i : i+4]))
+		end := i + 12 + chunklen
+		if end > len(bs) {
+			return nil, fmt.Errorf("invalid png chunk length at %d", i)
+		}
+		chunktype := string(bs[i+4 : i+8])
+		switch chunktype {
+		case "eXIf":
+			orientation = exifOrientation(bs[i+8 : i+8+chunklen])
+		case "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out.Write(bs[i:end])
+		}
+		i = end
 	}
-	return nil
-}
-func delEntry(db *sql.DB, entryid int64) error {
-	s := `DELETE FROM entry WHERE entry_id = ?`
-	_, err := sqlexec(db, s, entryid)
+
+	if orientation == 1 {
+		return out.Bytes(), nil
+	}
+	img, err := png.Decode(bytes.NewReader(out.Bytes()))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = setEntryTags(db, entryid, "")
+	var buf bytes.Buffer
+	err = png.Encode(&buf, orientImage(img, orientation))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return buf.Bytes(), nil
 }
 
-// Sets entry tags by removing any existing tags, then adding the new tags.
-func setEntryTags(db *sql.DB, entryid int64, tags string) error {
-	s := "DELETE FROM entrytag WHERE entry_id = ?"
-	_, err := sqlexec(db, s, entryid)
-	if err != nil {
-		return err
+// Returns orientation (1-8) from EXIF TIFF data, or 1 if not found.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
 	}
-
-	tt := strings.Split(tags, ",")
-	for _, t := range tt {
-		t = strings.TrimSpace(t)
-		if t == "" {
-			continue
+	var bo binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(bo.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	n := int(bo.Uint16(tiff[ifd : ifd+2]))
+	for k := 0; k < n; k++ {
+		e := ifd + 2 + k*12
+		if e+12 > len(tiff) {
+			return 1
 		}
-		s := "INSERT INTO entrytag (entry_id, tag) VALUES (?, ?)"
-		_, err := sqlexec(db, s, entryid, t)
-		if err != nil {
-			return err
+		if bo.Uint16(tiff[e:e+2]) == 0x0112 {
+			o := int(bo.Uint16(tiff[e+8 : e+10]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return o
 		}
 	}
-	return nil
+	return 1
+}
+
+// Returns image transformed by EXIF orientation so it displays upright.
+func orientImage(src image.Image, orientation int) *image.RGBA {
+	sb := src.Bounds()
+	srgba := image.NewRGBA(image.Rect(0, 0, sb.Dx(), sb.Dy()))
+	draw.Draw(srgba, srgba.Bounds(), src, sb.Min, draw.Src)
+	w, h := sb.Dx(), sb.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		// 5-8 swap width and height
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for sy := 0; sy < h; sy++ {
+		for sx := 0; sx < w; sx++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // flip horizontal
+				dx, dy = w-1-sx, sy
+			case 3: // rotate 180
+				dx, dy = w-1-sx, h-1-sy
+			case 4: // flip vertical
+				dx, dy = sx, h-1-sy
+			case 5: // transpose
+				dx, dy = sy, sx
+			case 6: // rotate 90 clockwise
+				dx, dy = h-1-sy, sx
+			case 7: // transverse
+				dx, dy = h-1-sy, w-1-sx
+			case 8: // rotate 90 counter-clockwise
+				dx, dy = sy, w-1-sx
+			default:
+				dx, dy = sx, sy
+			}
+			si := srgba.PixOffset(sx, sy)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], srgba.Pix[si:si+4])
+		}
+	}
+	return dst
 }
-func createFile(db *sql.DB, f *File) (int64, error) {
-	f.Filename = makeUniqueFilename(db, f.Filename)
 
-	s := "INSERT INTO file (filename, title, bytes, createdt, user_id) VALUES (?, ?, ?, ?, ?)"
-	result, err := sqlexec(db, s, f.Filename, f.Title, f.Bytes, f.Createdt, f.Userid)
-	if err != nil {
-		return 0, err
-	}
-	fileid, err := result.LastInsertId()
-	if err != nil {
-		return 0, err
+//*** HTML template functions ***
+
+func printHtmlOpen(P PrintFunc, title string, jsurls []string) {
+	P("<!DOCTYPE html>\n")
+	P("<html>\n")
+	P("<head>\n")
+	P("<meta charset=\"utf-8\">\n")
+	P("<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">\n")
+	P("<title>%s</title>\n", title)
+	P("<link rel=\"stylesheet\" type=\"text/css\" href=\"/static/style.css\">\n")
+	for _, jsurl := range jsurls {
+		P("<script defer src=\"%s\"></script>\n", jsurl)
 	}
-	return fileid, nil
+	P("<style>\n")
+	P(".myfont {font-family: Helvetica Neue,Helvetica,Arial,sans-serif;}\n")
+	P("</style>\n")
+	P("</head>\n")
+	P("<body class=\"text-base leading-6 myfont dark\">\n")
 }
-func editFile(db *sql.DB, f *File) error {
-	f.Filename = makeUniqueFilename(db, f.Filename)
-	s := "UPDATE file SET filename = ?, title = ?, bytes = ? WHERE file_id = ?"
-	_, err := sqlexec(db, s, f.Filename, f.Title, f.Bytes, f.Fileid)
-	if err != nil {
-		return err
-	}
-	return nil
+func printHtmlClose(P PrintFunc) {
+	P("</body>\n")
+	P("</html>\n")
 }
-func delFile(db *sql.DB, fileid int64) error {
-	s := `DELETE FROM file WHERE file_id = ?`
-	_, err := sqlexec(db, s, fileid)
-	if err != nil {
-		return err
-	}
-	return nil
+func printContainerOpen(P PrintFunc) {
+	P("<div id=\"container\" class=\"flex flex-col py-2 mx-auto max-w-screen-sm\">\n")
 }
-
-func dashboardHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	u, _ := validateLoginCookie(db, r)
+func printWideContainerOpen(P PrintFunc) {
+	P("<div id=\"container\" class=\"flex flex-col py-2 mx-auto max-w-screen-lg\">\n")
+}
+func printContainerHscreenOpen(P PrintFunc) {
+	P("<div id=\"container\" class=\"flex flex-col py-2 mx-auto max-w-screen-sm h-screen\">\n")
+}
+func printContainerClose(P PrintFunc) {
+	P("</div>\n")
+}
+func printHeading(P PrintFunc, u *User, pp *PageParams) {
+	P("<div class=\"flex flex-row justify-between border-b border-gray-500 pb-1 mb-4 text-sm\"\n>")
+	P("    <div>\n")
+	P("        <h1 class=\"inline self-end ml-1 mr-2 font-bold\"><a href=\"%s\">%s</a></h1>\n", pp.BaseUrl, pp.BlogTitle)
+	P("        <a href=\"%s?page=about\" class=\"self-end mr-2\">About</a>\n", pp.BaseUrl)
+	P("        <a href=\"%s?page=tags\" class=\"self-end mr-2\">Tags</a>\n", pp.BaseUrl)
+	if pp.Static {
+		P("    </div>\n")
+		P("</div>\n")
+		return
+	}
+	P("        <a href=\"%s?page=search\" class=\"self-end mr-2\">Search</a>\n", pp.BaseUrl)
+	P("        <a href=\"%s?page=atom\" class=\"self-end mr-2\">Feed</a>\n", pp.BaseUrl)
+	P("    </div>\n")
+	P("    <div>\n")
+	if u != nil {
+		P("        <div class=\"relative inline mr-2\">\n")
+		P("            <a class=\"mr-1\" href=\"%s?page=dashboard\">%s</a>\n", pp.BaseUrl, escape(u.Username))
+		P("        </div>\n")
+		P("        <a href=\"%s?page=logout\" class=\"inline self-end mr-1\">Logout</a>\n", pp.BaseUrl)
+	} else {
+		P("        <a href=\"%s?page=login\" class=\"inline self-end mr-1\">Login</a>\n", pp.BaseUrl)
+	}
+	P("    </div>\n")
+	P("</div>\n")
+}
+func printFormOpen(P PrintFunc, action, heading string) {
+	P("<form action=\"%s\" method=\"post\" class=\"flex-grow flex flex-col panel mx-auto py-2 px-8 text-sm w-full\">\n", action)
+	if heading != "" {
+		P("    <h1 class=\"font-bold mx-auto mb-2 text-center text-base\">%s</h1>\n", heading)
+	}
+}
+func printFormSmallOpen(P PrintFunc, action, heading string) {
+	P("<form action=\"%s\" method=\"post\" class=\"flex-grow flex flex-col panel mx-auto py-2 px-8 text-sm max-w-sm\">\n", action)
+	if heading != "" {
+		P("    <h1 class=\"font-bold mx-auto mb-2 text-center text-base\">%s</h1>\n", heading)
+	}
+}
+func printFormClose(P PrintFunc) {
+	P("</form>\n")
+}
+func printFormInput(P PrintFunc, id, label, val string) {
+	P("<div class=\"mb-2\">\n")
+	P("    <label class=\"block font-bold uppercase text-xs\" for=\"%s\">%s</label>\n", id, label)
+	P("    <input class=\"block border border-gray-500 py-1 px-4 w-full\" id=\"%[1]s\" name=\"%[1]s\" type=\"text\" value=\"%s\">\n", id, val)
+	P("</div>\n")
+}
+func printFormInputPassword(P PrintFunc, id, label, val string) {
+	P("<div class=\"mb-2\">\n")
+	P("    <label class=\"block font-bold uppercase text-xs\" for=\"%s\">%s</label>\n", id, label)
+	P("    <input class=\"block border border-gray-500 py-1 px-4 w-full\" id=\"%[1]s\" name=\"%[1]s\" type=\"password\" value=\"%s\">\n", id, val)
+	P("</div>\n")
+}
+func printFormTextarea(P PrintFunc, id, label, val string) {
+	P("<div class=\"flex-grow flex flex-col mb-2\">\n")
+	P("    <label class=\"block font-bold uppercase text-xs\" for=\"%s\">%s</label>\n", id, label)
+	P("    <textarea class=\"flex-grow block border border-gray-500 py-1 px-4 w-full leading-5\" id=\"%[1]s\" name=\"%[1]s\">%s</textarea>\n", id, val)
+	P("</div>\n")
+}
+func printFormError(P PrintFunc, errmsg string) {
+	if errmsg == "" {
+		return
+	}
+	P("<div class=\"mb-2\">\n")
+	P("    <p class=\"font-bold uppercase text-xs\">%s</p>\n", errmsg)
+	P("</div>\n")
+}
+func printFormSubmit(P PrintFunc, caption string) {
+	P("<div class=\"mb-2\">\n")
+	P("    <button type=\"submit\" class=\"inline w-full mx-auto py-1 px-2 border border-gray-500 font-bold mr-2\">%s</button>\n", caption)
+	P("</div>\n")
+}
+
+// Ex. printFormLinks(P, "justify-end", "/signup", "Sign Up", "/login", "Login")
+func printFormLinks(P PrintFunc, justify string, ss ...string) {
+	type Link struct {
+		Href    string
+		Caption string
+	}
+
+	if justify == "" {
+		justify = "justify-between"
+	}
+
+	var ll []Link
+	var l Link
+	for _, s := range ss {
+		if l.Href == "" {
+			l.Href = s
+			continue
+		}
+		if l.Caption == "" {
+			l.Caption = s
+			ll = append(ll, l)
+
+			l.Href = ""
+			l.Caption = ""
+		}
+
+	}
+
+	P("<div class=\"flex flex-row %s\">\n", justify)
+	for _, l := range ll {
+		P("    <a class=\"text-xs\" href=\"%s\">%s</a>\n", l.Href, l.Caption)
+	}
+	P("</div>\n")
+}
+func printDivOpen(P PrintFunc, heading string) {
+	P("<div class=\"panel mx-auto py-4 px-8 text-sm\">\n")
+	if heading != "" {
+		P("    <h1 class=\"font-bold mx-auto mb-2 text-center text-base\">%s</h1>\n", heading)
+	}
+}
+func printDivSmallOpen(P PrintFunc, heading string) {
+	P("<div class=\"panel mx-auto py-4 px-8 text-sm max-w-sm\">\n")
+	if heading != "" {
+		P("    <h1 class=\"font-bold mb-2 text-base\">%s</h1>\n", heading)
+	}
+}
+func printDivFlex(P PrintFunc, justify string) {
+	P("<div class=\"flex flex-row %s\">\n", justify)
+}
+func printDivClose(P PrintFunc) {
+	P("</div>\n")
+}
+
+func rootHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, _, slug := parseEntrySlugUrl(r); slug != "" {
+			entrySlugHandler(w, r, db)
+			return
+		}
+
+		page := r.FormValue("page")
+		if page == "index" || page == "" {
+			indexHandler(w, r, db)
+		} else if page == "about" {
+			aboutHandler(w, r, db)
+		} else if page == "tags" {
+			tagsHandler(w, r, db)
+		} else if page == "search" {
+			searchHandler(w, r, db)
+		} else if page == "entry" {
+			entryHandler(w, r, db)
+		} else if page == "file" {
+			fileHandler(w, r, db)
+		} else if page == "rss" || page == "atom" {
+			feedHandler(w, r, db)
+		} else if page == "comment" {
+			commentHandler(w, r, db)
+		} else if page == "login" {
+			loginHandler(w, r, db)
+		} else if page == "logout" {
+			logoutHandler(w, r, db)
+		} else if page == "signup" {
+			signupHandler(w, r, db)
+		} else if page == "dashboard" {
+			dashboardHandler(w, r, db)
+		}
+	}
+}
+
+func parsePageUrl(r *http.Request) (string, string) {
+	surl := strings.Trim(r.URL.EscapedPath(), "/")
+	ss := strings.Split(surl, "/")
+	sslen := len(ss)
+	if sslen == 0 {
+		return "", ""
+	} else if sslen == 1 {
+		return pathunescape(ss[0]), ""
+	}
+	return pathunescape(ss[0]), pathunescape(ss[1])
+}
+
+// Parses entry permalink url into username, yyyy/mm date and slug.
+// Returns empty slug if url is not an entry permalink.
+// Ex. /user123/2026/10/my-post returns ("user123", "2026/10", "my-post"),
+// /post/my-post returns ("", "", "my-post")
+func parseEntrySlugUrl(r *http.Request) (string, string, string) {
+	surl := strings.Trim(r.URL.EscapedPath(), "/")
+	ss := strings.Split(surl, "/")
+	if len(ss) == 2 && ss[0] == "post" {
+		return "", "", pathunescape(ss[1])
+	}
+	if len(ss) == 4 {
+		return pathunescape(ss[0]), fmt.Sprintf("%s/%s", ss[1], ss[2]), pathunescape(ss[3])
+	}
+	return "", "", ""
+}
+func getPageParams(r *http.Request, db *sql.DB) *PageParams {
+	var pp PageParams
+
+	site := findSite(db)
+	pp.IsGroup = site.IsGroup
+	pp.BlogTitle = site.Title
+	pp.BaseUrl = "/"
+	pp.Static = isStaticExport(r)
+
+	blogusername, _ := parsePageUrl(r)
+	if blogusername == "" {
+		return &pp
+	}
+	u := findUserByUsername(db, blogusername)
 	if u == nil {
-		http.Error(w, "Must be logged in", 401)
+		return &pp
+	}
+	pp.BlogUserid = u.Userid
+	pp.BlogUsername = u.Username
+
+	if site.IsGroup {
+		return &pp
+	}
+
+	// user blog space Ex. /user123
+	// Use usersettings title and make /user123 the base url
+	us := findUserSettingsById(db, u.Userid)
+	pp.BlogTitle = escape(us.BlogTitle)
+	pp.BaseUrl = fmt.Sprintf("/%s", blogusername)
+	return &pp
+}
+func indexHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	u, _ := validateLoginCookie(db, r)
+
+	pp := getPageParams(r, db)
+	qtag := r.FormValue("tag")
+	qp := atoi(r.FormValue("p"))
+	if qp < 1 {
+		qp = 1
+	}
+	ee, err := findEntries(db, nil, pp.BlogUserid, qtag, 0, entriesPageSize, (qp-1)*entriesPageSize)
+	if handleDbErr(w, err, "indexHandler") {
+		return
+	}
+	total, err := countEntries(db, nil, pp.BlogUserid, qtag)
+	if handleDbErr(w, err, "indexHandler") {
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/html")
 	P := makeFprintf(w)
-	pp := getPageParams(r, db)
-	printHtmlOpen(P, pp.BlogTitle, []string{"/static/bundle.js", "/static/dashboard.js"})
-	printWideContainerOpen(P)
+	printHtmlOpen(P, pp.BlogTitle, nil)
+	printContainerOpen(P)
 	printHeading(P, u, pp)
 
+	title := "Latest Posts"
+	if pp.IsGroup && pp.BlogUsername != "" {
+		title += fmt.Sprintf(" from %s", escape(pp.BlogUsername))
+	}
+	if qtag != "" {
+		title += fmt.Sprintf(" tagged '%s'", escape(qtag))
+	}
+
+	P("<h1 class=\"font-bold text-lg mb-2\">%s</h1>\n", title)
+	for _, e := range ee {
+		P("<div class=\"flex flex-row py-1\">\n")
+		P("    <p class=\"text-xs text-gray-700\">%s</p>\n", formatdate(e.Createdt))
+		P("    <p class=\"flex-grow px-4\">\n")
+		P("        <a class=\"action font-bold\" href=\"%s\">%s</a>\n", entryurl(e), escape(e.Title))
+		P("    </p>\n")
+		if pp.IsGroup || pp.BlogUserid == 0 {
+			P("    <a class=\"text-xs text-gray-700 px-2\" href=\"/%s\">%s</a>\n", pathescape(e.Username), escape(e.Username))
+		}
+		P("</div>\n")
+	}
+	printPageLinks(P, pp, qtag, qp, total)
+
 	printContainerClose(P)
 	printHtmlClose(P)
 }
 
-func apichangepwdHandler(db *sql.DB) http.HandlerFunc {
-	type Req struct {
-		Userid int64  `json:"userid"`
-		Pwd    string `json:"pwd"`
-		Newpwd string `json:"newpwd"`
+// Number of entries per page in entry listings.
+const entriesPageSize = 20
+
+// Prints newer/older links for page p of a listing containing total entries.
+func printPageLinks(P PrintFunc, pp *PageParams, qtag string, p, total int) {
+	npages := (total + entriesPageSize - 1) / entriesPageSize
+	if npages <= 1 {
+		return
+	}
+	pageurl := func(p int) string {
+		v := url.Values{}
+		if qtag != "" {
+			v.Set("tag", qtag)
+		}
+		if p > 1 {
+			v.Set("p", strconv.Itoa(p))
+		}
+		if len(v) == 0 {
+			return pp.BaseUrl
+		}
+		return fmt.Sprintf("%s?%s", pp.BaseUrl, v.Encode())
+	}
+
+	P("<div class=\"flex flex-row justify-between mt-4 text-sm\">\n")
+	if p > 1 {
+		P("    <a class=\"action\" href=\"%s\">&larr; Newer posts</a>\n", escape(pageurl(p-1)))
+	} else {
+		P("    <span></span>\n")
+	}
+	P("    <span class=\"text-xs text-gray-700\">Page %d of %d</span>\n", p, npages)
+	if p < npages {
+		P("    <a class=\"action\" href=\"%s\">Older posts &rarr;</a>\n", escape(pageurl(p+1)))
+	} else {
+		P("    <span></span>\n")
+	}
+	P("</div>\n")
+}
+
+func tagsHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	u, _ := validateLoginCookie(db, r)
+
+	pp := getPageParams(r, db)
+
+	w.Header().Set("Content-Type", "text/html")
+	P := makeFprintf(w)
+	printHtmlOpen(P, pp.BlogTitle, nil)
+	printContainerOpen(P)
+	printHeading(P, u, pp)
+
+	P("<h1 class=\"font-bold text-lg mb-2\">Tags</h1>\n")
+	P("<div class=\"flex flex-col py-1\">\n")
+
+	swhere, qq := entryVisibleWhere(nil)
+
+	if pp.BlogUserid != 0 {
+		swhere += " AND e.user_id = ?"
+		qq = append(qq, pp.BlogUserid)
+	}
+
+	s := fmt.Sprintf(`SELECT et.tag, COUNT(*) AS numentries 
+FROM entrytag et 
+INNER JOIN entry e ON et.entry_id = e.entry_id 
+WHERE %s 
+GROUP BY et.tag 
+ORDER BY numentries DESC`, swhere)
+	rows, err := db.Query(s, qq...)
+	if handleDbErr(w, err, "tagsHandler") {
+		return
+	}
+	for rows.Next() {
+		var tag string
+		var numentries int
+		rows.Scan(&tag, &numentries)
+		P("<p>\n")
+		P("  <a class=\"action mr-1\" href=\"%s?tag=%s\">%s</a>\n", pp.BaseUrl, qescape(tag), escape(tag))
+		P("  <span class=\"text-sm\">(%d)</span>\n", numentries)
+		P("</p>\n")
+	}
+	P("</div>\n")
+
+	printContainerClose(P)
+	printHtmlClose(P)
+}
+
+// GET /?page=search&q=abc
+// GET /user123?page=search&q=abc
+func searchHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	u, _ := validateLoginCookie(db, r)
+
+	pp := getPageParams(r, db)
+	q := strings.TrimSpace(r.FormValue("q"))
+	ee, err := searchEntries(db, nil, pp.BlogUserid, q, 50, 0)
+	if handleDbErr(w, err, "searchHandler") {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	P := makeFprintf(w)
+	printHtmlOpen(P, pp.BlogTitle, nil)
+	printContainerOpen(P)
+	printHeading(P, u, pp)
+
+	title := "Search"
+	if pp.IsGroup && pp.BlogUsername != "" {
+		title += fmt.Sprintf(" posts from %s", escape(pp.BlogUsername))
+	}
+	P("<h1 class=\"font-bold text-lg mb-2\">%s</h1>\n", title)
+	P("<form action=\"%s\" method=\"get\" class=\"flex flex-row mb-2\">\n", pp.BaseUrl)
+	P("    <input type=\"hidden\" name=\"page\" value=\"search\">\n")
+	P("    <input class=\"flex-grow block border border-gray-500 py-1 px-4 w-full leading-5\" name=\"q\" type=\"text\" placeholder=\"search entries\" value=\"%s\">\n", escape(q))
+	P("    <button type=\"submit\" class=\"inline py-1 px-4 border-t border-r border-b border-gray-500 font-bold\">Search</button>\n")
+	P("</form>\n")
+
+	if q != "" {
+		P("<p class=\"text-xs text-gray-700 mb-2\">%d results found</p>\n", len(ee))
+	}
+	for _, e := range ee {
+		P("<div class=\"py-1\">\n")
+		P("    <div class=\"flex flex-row\">\n")
+		P("        <p class=\"text-xs text-gray-700\">%s</p>\n", formatdate(e.Createdt))
+		P("        <p class=\"flex-grow px-4\">\n")
+		P("            <a class=\"action font-bold\" href=\"%s\">%s</a>\n", entryurl(e), escape(e.Title))
+		P("        </p>\n")
+		if pp.IsGroup || pp.BlogUserid == 0 {
+			P("        <a class=\"text-xs text-gray-700 px-2\" href=\"/%s\">%s</a>\n", pathescape(e.Username), escape(e.Username))
+		}
+		P("    </div>\n")
+		P("    <p class=\"text-sm text-gray-700\">%s</p>\n", e.Snippet)
+		P("</div>\n")
+	}
+
+	printContainerClose(P)
+	printHtmlClose(P)
+}
+
+func aboutHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	u, _ := validateLoginCookie(db, r)
+
+	w.Header().Set("Content-Type", "text/html")
+	P := makeFprintf(w)
+	pp := getPageParams(r, db)
+	printHtmlOpen(P, pp.BlogTitle, nil)
+	printContainerOpen(P)
+	printHeading(P, u, pp)
+
+	var aboutBody string
+	if pp.BlogUserid == 0 {
+		aboutBody = findSiteAbout(db)
+	} else {
+		aboutBody = findUserAboutById(db, pp.BlogUserid)
+	}
+
+	P("<div class=\"content\">\n")
+	P("%s\n", parseMarkdown(db, aboutBody))
+	P("</div>\n")
+
+	printContainerClose(P)
+	printHtmlClose(P)
+}
+
+func entryHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	u, _ := validateLoginCookie(db, r)
+
+	qid := idtoi(r.FormValue("id"))
+	if qid == 0 {
+		http.Error(w, "Not found.", 404)
+		return
+	}
+	e := findEntry(db, qid)
+	if e == nil || !canViewEntry(u, e) {
+		http.Error(w, "Not found.", 404)
+		return
+	}
+	if e.Slug != "" {
+		http.Redirect(w, r, entryurl(e), http.StatusMovedPermanently)
+		return
+	}
+	printEntryPage(w, r, db, u, e)
+}
+
+// GET /user123/2026/10/my-post
+// GET /post/my-post
+// Redirects to the canonical url if an old slug or different path was used.
+func entrySlugHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	u, _ := validateLoginCookie(db, r)
+
+	username, yyyymm, slug := parseEntrySlugUrl(r)
+	e := findEntryBySlug(db, slug)
+	if e == nil || !canViewEntry(u, e) {
+		http.Error(w, "Not found.", 404)
+		return
+	}
+	if slug != e.Slug || username != e.Username || (yyyymm != "" && yyyymm != parseisodate(e.Createdt).Format("2006/01")) {
+		http.Redirect(w, r, entryurl(e), http.StatusMovedPermanently)
+		return
+	}
+	printEntryPage(w, r, db, u, e)
+}
+func printEntryPage(w http.ResponseWriter, r *http.Request, db *sql.DB, u *User, e *Entry) {
+	w.Header().Set("Content-Type", "text/html")
+	P := makeFprintf(w)
+	pp := getPageParams(r, db)
+	printHtmlOpen(P, pp.BlogTitle, nil)
+	printContainerOpen(P)
+	printHeading(P, u, pp)
+
+	printEntry(P, db, e, pp)
+	if !pp.Static {
+		printComments(P, db, e, u, atoi(r.FormValue("replyto")), r.FormValue("commented") != "")
+	}
+
+	printContainerClose(P)
+	printHtmlClose(P)
+}
+
+// Prints approved comments of entry as threads, followed by the comment form.
+func printComments(P PrintFunc, db *sql.DB, e *Entry, u *User, replyto int, commented bool) {
+	cc, err := findComments(db, e.Entryid, CommentApproved)
+	if err != nil {
+		logErr("printComments", err)
+		return
+	}
+	replies := map[int64][]*Comment{}
+	for _, c := range cc {
+		replies[c.Parentid] = append(replies[c.Parentid], c)
+	}
+
+	P("<div id=\"comments\" class=\"mt-8 border-t border-gray-500 pt-2\">\n")
+	P("<h2 class=\"font-bold mb-2\">Comments (%d)</h2>\n", len(cc))
+	printCommentThread(P, db, e, replies, 0)
+
+	if commented {
+		P("<p class=\"italic text-sm mb-2\">Your comment was submitted and will appear once approved.</p>\n")
+	}
+
+	P("<form id=\"commentform\" action=\"/?page=comment\" method=\"post\" class=\"flex flex-col text-sm\">\n")
+	P("    <input type=\"hidden\" name=\"entryid\" value=\"%d\">\n", e.Entryid)
+	P("    <input type=\"hidden\" name=\"parentid\" value=\"%d\">\n", replyto)
+	if replyto != 0 {
+		P("    <p class=\"mb-2\">Replying to comment <a class=\"action\" href=\"#comment%d\">#%d</a></p>\n", replyto, replyto)
+	}
+	if u == nil {
+		printFormInput(P, "name", "name", "")
+	}
+	printFormTextarea(P, "body", "comment", "")
+	printFormSubmit(P, "Add Comment")
+	P("</form>\n")
+	P("</div>\n")
+}
+func printCommentThread(P PrintFunc, db *sql.DB, e *Entry, replies map[int64][]*Comment, parentid int64) {
+	for _, c := range replies[parentid] {
+		P("<div id=\"comment%d\" class=\"mb-2\">\n", c.Commentid)
+		P("    <p class=\"text-xs text-gray-700\">%s on %s \n", escape(c.Name), formatdate(c.Createdt))
+		P("        <a class=\"action ml-2\" href=\"%s?replyto=%d#commentform\">reply</a>\n", entryurl(e), c.Commentid)
+		P("    </p>\n")
+		P("    <div class=\"content text-sm\">\n")
+		P("%s\n", parseMarkdown(db, c.Body))
+		P("    </div>\n")
+		if len(replies[c.Commentid]) > 0 {
+			P("    <div class=\"ml-4 pl-2 border-l border-gray-500\">\n")
+			printCommentThread(P, db, e, replies, c.Commentid)
+			P("    </div>\n")
+		}
+		P("</div>\n")
+	}
+}
+func printEntry(P PrintFunc, db *sql.DB, e *Entry, pp *PageParams) {
+	P("<h1 class=\"font-bold text-2xl mb-2\">%s</h1>\n", escape(e.Title))
+	if e.Username != "" {
+		P("<p class=\"mb-4 text-sm\">Posted on \n")
+		P("    <span class=\"italic\">%s</span> by \n", formatdate(e.Createdt))
+		P("    <a href=\"/%s\" class=\"action\">%s</a>\n", pathescape(e.Username), escape(e.Username))
+		P("</p>\n")
+	} else {
+		P("<p class=\"mb-4 text-sm\">Posted on <span class=\"italic\">%s</span></p>\n", formatdate(e.Createdt))
+	}
+	P("<div class=\"content\">\n")
+	P("%s\n", parseMarkdown(db, e.Body))
+	P("</div>\n")
+
+	printTags(P, e.Tags, pp)
+}
+func printTags(P PrintFunc, tags string, pp *PageParams) {
+	if tags == "" {
+		return
+	}
+
+	P("<p class=\"mt-4 italic text-sm\">Tags: \n")
+	tt := strings.Split(tags, ",")
+	for i, t := range tt {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		P("    <a href=\"%s?tag=%s\" class=\"italic action\">%s</a>", pp.BaseUrl, qescape(t), escape(t))
+		if i < len(tt)-1 {
+			P(", ")
+		}
+	}
+	P("</p>\n")
+}
+
+// Returns public base url of site for absolute links: -baseurl if set,
+// otherwise the scheme and host the request was made to.
+// Ex. "http://localhost:8000"
+func requestHostUrl(r *http.Request) string {
+	if siteBaseUrl != "" {
+		return siteBaseUrl
+	}
+	scheme := "http"
+	if isHttps(r) {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+// GET /?page=rss
+// GET /?page=atom
+// GET /user123?page=atom
+// GET /?tag=abc&page=atom
+func feedHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	pp := getPageParams(r, db)
+	qtag := r.FormValue("tag")
+	qpage := r.FormValue("page")
+
+	ee, err := findEntries(db, nil, pp.BlogUserid, qtag, 0, 20, 0)
+	if handleDbErr(w, err, "feedHandler") {
+		return
+	}
+
+	hosturl := requestHostUrl(r)
+	title := unescape(pp.BlogTitle)
+	if pp.IsGroup && pp.BlogUsername != "" {
+		title += fmt.Sprintf(" - %s", pp.BlogUsername)
+	}
+	if qtag != "" {
+		title += fmt.Sprintf(" - %s", qtag)
+	}
+
+	feed := &feeds.Feed{
+		Title:       title,
+		Link:        &feeds.Link{Href: hosturl + pp.BaseUrl},
+		Description: title,
+		Created:     time.Now(),
+	}
+	if len(ee) > 0 {
+		feed.Created = parseisodate(ee[0].Createdt)
+	}
+	for _, e := range ee {
+		link := hosturl + entryurl(e)
+		item := &feeds.Item{
+			Title:   e.Title,
+			Link:    &feeds.Link{Href: link},
+			Id:      link,
+			Created: parseisodate(e.Createdt),
+			Content: parseMarkdown(db, e.Body),
+		}
+		if e.Username != "" {
+			item.Author = &feeds.Author{Name: e.Username}
+		}
+		feed.Items = append(feed.Items, item)
+	}
+
+	var s string
+	if qpage == "rss" {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		s, err = feed.ToRss()
+	} else {
+		w.Header().Set("Content-Type", "application/atom+xml")
+		s, err = feed.ToAtom()
+	}
+	if err != nil {
+		handleErr(w, err, "feedHandler")
+		return
+	}
+	P := makeFprintf(w)
+	P("%s", s)
+}
+
+// GET /?page=file&id=123
+// GET /?page=file&filename=file1.jpg
+// GET /?page=file&id=123&w=320
+func fileHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	qid := idtoi(r.FormValue("id"))
+	qfilename := r.FormValue("filename")
+	if qid == 0 && qfilename == "" {
+		http.Error(w, "Specify id or filename (id=nnn or filename=file1.jpg)", 401)
+		return
+	}
+	var f *File
+	if qid > 0 {
+		f = findFile(db, qid)
+	} else if qfilename != "" {
+		f = findFileByFilename(db, qfilename)
+	}
+	if f == nil {
+		http.Error(w, "Not found.", 404)
+		return
+	}
+
+	mimetype := f.Mimetype
+	if mimetype == "" {
+		// Files uploaded before mime types were stored.
+		var err error
+		mimetype, err = sniffFileContents(db, f)
+		if err != nil {
+			handleErr(w, err, "fileHandler")
+			return
+		}
+	}
+
+	// ?w=320 returns a resized copy of images, as webp if the client
+	// accepts it.
+	qw := atoi(r.FormValue("w"))
+	if qw > 0 && isResizableImage(mimetype) {
+		w.Header().Set("Vary", "Accept")
+		v, err := findOrCreateImageVariant(db, f, qw, strings.Contains(r.Header.Get("Accept"), "image/webp"))
+		if err != nil {
+			handleErr(w, err, "fileHandler")
+			return
+		}
+		if v != nil {
+			vf := *f
+			vf.Blobkey = v.Blobkey
+			vf.Size = v.Size
+			mimetype = v.Mimetype
+			w.Header().Set("Content-Type", mimetype)
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": f.Filename}))
+			serveFileContents(w, r, db, &vf)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", mimetype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// Uploaded html or svg could run scripts in the site's origin.
+	// Sandbox them, and make browsers download html instead of rendering it.
+	disposition := "inline"
+	if isActiveMimetype(mimetype) {
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox")
+		if !strings.HasPrefix(mimetype, "image/") {
+			disposition = "attachment"
+		}
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": f.Filename}))
+	serveFileContents(w, r, db, f)
+}
+
+// Common types that aren't always in the system's mime.types.
+var extraMimetypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".ogv":  "video/ogg",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".wav":  "audio/wav",
+	".flac": "audio/flac",
+	".bmp":  "image/bmp",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".ico":  "image/x-icon",
+	".txt":  "text/plain; charset=utf-8",
+	".md":   "text/markdown; charset=utf-8",
+	".csv":  "text/csv; charset=utf-8",
+	".zip":  "application/zip",
+	".gz":   "application/gzip",
+	".epub": "application/epub+zip",
+}
+
+// Returns mime type of file from its extension and first bytes of contents.
+// The extension is trusted unless the contents sniff as html, so that
+// html can't be uploaded under an innocent looking extension.
+func detectMimetype(filename string, head []byte) string {
+	sniffed := http.DetectContentType(head)
+	if strings.HasPrefix(sniffed, "text/html") {
+		return sniffed
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext != "" {
+		t := mime.TypeByExtension(ext)
+		if t == "" {
+			t = extraMimetypes[ext]
+		}
+		if t != "" {
+			return t
+		}
+	}
+	return sniffed
+}
+
+// Returns true for types that browsers may run scripts from.
+func isActiveMimetype(mimetype string) bool {
+	t, _, _ := mime.ParseMediaType(mimetype)
+	switch t {
+	case "text/html", "application/xhtml+xml", "image/svg+xml", "text/xml", "application/xml", "application/xslt+xml":
+		return true
+	}
+	return false
+}
+
+// Detects mime type of stored file contents.
+func sniffFileContents(db *sql.DB, f *File) (string, error) {
+	rc, err := openFileContents(db, f)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(rc, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return detectMimetype(f.Filename, head[:n]), nil
+}
+
+// Serves file contents with ETag, Last-Modified and Cache-Control headers.
+// http.ServeContent handles conditional requests (304) and byte ranges.
+func serveFileContents(w http.ResponseWriter, r *http.Request, db *sql.DB, f *File) {
+	rc, err := openFileContents(db, f)
+	if err != nil {
+		handleErr(w, err, "serveFileContents")
+		return
+	}
+	defer rc.Close()
+
+	// Blob keys are content hashes, so they make strong etags.
+	etag := f.Blobkey
+	if etag == "" {
+		h := sha256.New()
+		io.Copy(h, rc)
+		etag = hex.EncodeToString(h.Sum(nil))
+		rc.Seek(0, io.SeekStart)
+	}
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", etag))
+	if fileCacheMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(fileCacheMaxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, f.Filename, parseisodate(f.Createdt), rc)
+}
+
+// POST /?page=comment (entryid, parentid, name, body)
+// Adds comment from the entry page form and returns to the entry.
+func commentHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if r.Method != "POST" {
+		http.Error(w, "Use POST method", 401)
+		return
+	}
+	u, _ := validateLoginCookie(db, r)
+
+	e := findEntry(db, idtoi(r.FormValue("entryid")))
+	if e == nil || !canViewEntry(u, e) {
+		http.Error(w, "Not found.", 404)
+		return
+	}
+	var c Comment
+	c.Parentid = idtoi(r.FormValue("parentid"))
+	c.Name = r.FormValue("name")
+	c.Body = r.FormValue("body")
+	_, err := createComment(db, &c, e, u)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("%s?commented=1#comments", entryurl(e)), http.StatusSeeOther)
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	u, _ := validateLoginCookie(db, r)
+	pp := getPageParams(r, db)
+
+	var errmsg string
+	var f struct{ username, pwd string }
+
+	if r.Method == "POST" {
+		f.username = r.FormValue("username")
+		f.pwd = r.FormValue("pwd")
+		for {
+			u, err := loginUsername(db, f.username, f.pwd)
+			if err != nil {
+				errmsg = fmt.Sprintf("%s", err)
+				break
+			}
+			token, sess, err := createSession(db, u, r)
+			if err != nil {
+				errmsg = fmt.Sprintf("%s", err)
+				break
+			}
+			setLoginCookie(w, r, u, token, sess)
+
+			http.Redirect(w, r, fmt.Sprintf("/%s", pathescape(u.Username)), http.StatusSeeOther)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	P := makeFprintf(w)
+	printHtmlOpen(P, pp.BlogTitle, nil)
+	printContainerOpen(P)
+	printHeading(P, u, pp)
+
+	printFormSmallOpen(P, fmt.Sprintf("%s?page=login", pp.BaseUrl), "Log In")
+	printFormInput(P, "username", "username", f.username)
+	printFormInputPassword(P, "pwd", "password", f.pwd)
+	printFormError(P, errmsg)
+	printFormSubmit(P, "Login")
+	printFormLinks(P, "", fmt.Sprintf("%s?page=signup", pp.BaseUrl), "Create New Account", "/", "Cancel")
+	printFormClose(P)
+
+	printContainerClose(P)
+	printHtmlClose(P)
+}
+func logoutHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	logout(db, r)
+	delLoginCookie(w)
+
+	pp := getPageParams(r, db)
+	http.Redirect(w, r, fmt.Sprintf("%s", pp.BaseUrl), http.StatusSeeOther)
+}
+func signupHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	u, _ := validateLoginCookie(db, r)
+	pp := getPageParams(r, db)
+
+	var errmsg string
+	var f struct{ username, pwd, pwd2 string }
+
+	if r.Method == "POST" {
+		f.username = r.FormValue("username")
+		f.pwd = r.FormValue("pwd")
+		f.pwd2 = r.FormValue("pwd2")
+		for {
+			if f.pwd != f.pwd2 {
+				errmsg = "passwords don't match"
+				break
+			}
+			err := signup(db, f.username, f.pwd)
+			if err != nil {
+				errmsg = fmt.Sprintf("%s", err)
+				break
+			}
+			u, err := loginUsername(db, f.username, f.pwd)
+			if err != nil {
+				errmsg = fmt.Sprintf("%s", err)
+				break
+			}
+			token, sess, err := createSession(db, u, r)
+			if err != nil {
+				errmsg = fmt.Sprintf("%s", err)
+				break
+			}
+			setLoginCookie(w, r, u, token, sess)
+
+			http.Redirect(w, r, fmt.Sprintf("/%s", pathescape(u.Username)), http.StatusSeeOther)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	P := makeFprintf(w)
+	printHtmlOpen(P, pp.BlogTitle, nil)
+	printContainerOpen(P)
+	printHeading(P, u, pp)
+
+	printFormSmallOpen(P, fmt.Sprintf("%s?page=signup", pp.BaseUrl), "Sign Up")
+	printFormInput(P, "username", "username", f.username)
+	printFormInputPassword(P, "pwd", "password", f.pwd)
+	printFormInputPassword(P, "pwd2", "re-enter password", f.pwd2)
+	printFormError(P, errmsg)
+	printFormSubmit(P, "Sign Up")
+	printFormLinks(P, "justify-end", "/", "Cancel")
+	printFormClose(P)
+
+	printContainerClose(P)
+	printHtmlClose(P)
+}
+
+// Adds entry with its tags, first revision and search index in one
+// transaction. If notify is set and the entry is published, a publish event
+// is queued in the same transaction, to be delivered by deliverPublishEvents().
+func createEntry(db *sql.DB, e *Entry, notify bool) (int64, error) {
+	if e.Slug == "" {
+		e.Slug = e.Title
+	}
+	err := withWriteTx(db, func(tx *sql.Tx) error {
+		e.Slug = makeUniqueSlug(tx, e.Slug, 0)
+
+		s := "INSERT INTO entry (title, body, createdt, user_id, status, publishat, slug) VALUES (?, ?, ?, ?, ?, ?, ?)"
+		result, err := txexec(tx, s, e.Title, e.Body, e.Createdt, e.Userid, e.Status, e.Publishat, e.Slug)
+		if err != nil {
+			return err
+		}
+		e.Entryid, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		err = setEntryTags(tx, e.Entryid, e.Tags)
+		if err != nil {
+			return err
+		}
+		err = createEntryRevision(tx, e, e.Userid)
+		if err != nil {
+			return err
+		}
+		if notify && e.Status == EntryPublished {
+			err = queuePublishEvent(tx, e.Entryid)
+			if err != nil {
+				return err
+			}
+		}
+		return indexEntry(tx, e)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return e.Entryid, nil
+}
+
+// Updates entry and records the new contents as a revision made by editorid.
+// The update, revision and search index change in one transaction, so
+// concurrent saves can't leave content and history out of sync. Publishing
+// a draft or scheduled entry queues a publish event in the same transaction.
+func editEntry(db *sql.DB, e *Entry, editorid int64) error {
+	olde := findEntry(db, e.Entryid)
+	if e.Slug == "" {
+		e.Slug = e.Title
+	}
+
+	return withWriteTx(db, func(tx *sql.Tx) error {
+		// Entries created before revisions were tracked have no history yet.
+		// Save the current contents first so they can still be restored.
+		if olde != nil && findLatestEntryRevision(tx, e.Entryid) == 0 {
+			err := createEntryRevision(tx, olde, olde.Userid)
+			if err != nil {
+				return err
+			}
+		}
+
+		var oldslug, oldstatus string
+		s := "SELECT IFNULL(slug, ''), status FROM entry WHERE entry_id = ?"
+		tx.QueryRow(s, e.Entryid).Scan(&oldslug, &oldstatus)
+		e.Slug = makeUniqueSlug(tx, e.Slug, e.Entryid)
+
+		s = "UPDATE entry SET title = ?, body = ?, status = ?, publishat = ?, slug = ? WHERE entry_id = ?"
+		_, err := txexec(tx, s, e.Title, e.Body, e.Status, e.Publishat, e.Slug, e.Entryid)
+		if err != nil {
+			return err
+		}
+
+		// Keep the old slug so that links to it can be redirected.
+		if oldslug != "" && oldslug != e.Slug {
+			s = "INSERT OR REPLACE INTO entry_slug (slug, entry_id) VALUES (?, ?)"
+			_, err = txexec(tx, s, oldslug, e.Entryid)
+			if err != nil {
+				return err
+			}
+		}
+		s = "DELETE FROM entry_slug WHERE slug = ?"
+		_, err = txexec(tx, s, e.Slug)
+		if err != nil {
+			return err
+		}
+
+		err = setEntryTags(tx, e.Entryid, e.Tags)
+		if err != nil {
+			return err
+		}
+		err = createEntryRevision(tx, e, editorid)
+		if err != nil {
+			return err
+		}
+		if e.Status == EntryPublished && oldstatus != EntryPublished {
+			err = queuePublishEvent(tx, e.Entryid)
+			if err != nil {
+				return err
+			}
+		}
+		return indexEntry(tx, e)
+	})
+}
+func delEntry(db *sql.DB, entryid int64) error {
+	return withWriteTx(db, func(tx *sql.Tx) error {
+		for _, s := range []string{
+			"DELETE FROM entry WHERE entry_id = ?",
+			"DELETE FROM entrytag WHERE entry_id = ?",
+			"DELETE FROM entry_revision WHERE entry_id = ?",
+			"DELETE FROM entry_slug WHERE entry_id = ?",
+			"DELETE FROM comment WHERE entry_id = ?",
+		} {
+			_, err := txexec(tx, s, entryid)
+			if err != nil {
+				return err
+			}
+		}
+		return unindexEntry(tx, entryid)
+	})
+}
+
+// Returns the latest revision number of entry, or 0 if it has no revisions.
+func findLatestEntryRevision(db sqlQueryer, entryid int64) int64 {
+	s := "SELECT IFNULL(MAX(rev), 0) FROM entry_revision WHERE entry_id = ?"
+	row := db.QueryRow(s, entryid)
+	var rev int64
+	err := row.Scan(&rev)
+	if err != nil {
+		return 0
+	}
+	return rev
+}
+func createEntryRevision(tx *sql.Tx, e *Entry, userid int64) error {
+	rev := findLatestEntryRevision(tx, e.Entryid) + 1
+	s := "INSERT INTO entry_revision (entry_id, rev, title, body, tags, createdt, user_id) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	_, err := txexec(tx, s, e.Entryid, rev, e.Title, e.Body, e.Tags, isodate(time.Now()), userid)
+	return err
+}
+func findEntryRevision(db *sql.DB, entryid, rev int64) *EntryRevision {
+	s := `SELECT entry_id, rev, title, body, tags, createdt, IFNULL(u.user_id, 0), IFNULL(u.username, '') 
+FROM entry_revision r 
+LEFT OUTER JOIN user u ON u.user_id = r.user_id 
+WHERE entry_id = ? AND rev = ?`
+	row := db.QueryRow(s, entryid, rev)
+	var er EntryRevision
+	err := row.Scan(&er.Entryid, &er.Rev, &er.Title, &er.Body, &er.Tags, &er.Createdt, &er.Userid, &er.Username)
+	if err != nil {
+		return nil
+	}
+	return &er
+}
+func findEntryRevisions(db *sql.DB, entryid int64) ([]*EntryRevision, error) {
+	s := `SELECT entry_id, rev, title, body, tags, createdt, IFNULL(u.user_id, 0), IFNULL(u.username, '') 
+FROM entry_revision r 
+LEFT OUTER JOIN user u ON u.user_id = r.user_id 
+WHERE entry_id = ? 
+ORDER BY rev DESC`
+	rows, err := db.Query(s, entryid)
+	if err != nil {
+		return nil, err
+	}
+	rr := []*EntryRevision{}
+	for rows.Next() {
+		var er EntryRevision
+		rows.Scan(&er.Entryid, &er.Rev, &er.Title, &er.Body, &er.Tags, &er.Createdt, &er.Userid, &er.Username)
+		rr = append(rr, &er)
+	}
+	return rr, nil
+}
+
+// Text representation of revision used for diffs.
+func revisionText(er *EntryRevision) string {
+	return fmt.Sprintf("title: %s\ntags: %s\n\n%s", er.Title, er.Tags, er.Body)
+}
+
+type diffOp struct {
+	kind byte // ' ' (same), '-' (removed) or '+' (added)
+	aidx int  // index into a lines
+	bidx int  // index into b lines
+	line string
+}
+
+// Returns the line operations to turn a into b, using longest common subsequence.
+func diffLines(a, b []string) []diffOp {
+	n := len(a)
+	m := len(b)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < n || j < m {
+		if i < n && j < m && a[i] == b[j] {
+			ops = append(ops, diffOp{' ', i, j, a[i]})
+			i++
+			j++
+		} else if j == m || (i < n && lcs[i+1][j] >= lcs[i][j+1]) {
+			ops = append(ops, diffOp{'-', i, j, a[i]})
+			i++
+		} else {
+			ops = append(ops, diffOp{'+', i, j, b[j]})
+			j++
+		}
+	}
+	return ops
+}
+
+// Returns unified diff (3 lines of context) between atext and btext.
+func unifiedDiff(aname, bname, atext, btext string) string {
+	const nctx = 3
+	ops := diffLines(strings.Split(atext, "\n"), strings.Split(btext, "\n"))
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n", aname)
+	fmt.Fprintf(&sb, "+++ %s\n", bname)
+
+	i := 0
+	for i < len(ops) {
+		// Skip to the next change.
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+
+		// Extend hunk to include changes separated by no more than 2*nctx unchanged lines.
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			k := end
+			for k < len(ops) && ops[k].kind == ' ' {
+				k++
+			}
+			if k == len(ops) || k-end > 2*nctx {
+				break
+			}
+			end = k
+		}
+
+		start := i - nctx
+		if start < 0 {
+			start = 0
+		}
+		stop := end + nctx
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+		hunk := ops[start:stop]
+
+		var alen, blen int
+		for _, op := range hunk {
+			if op.kind != '+' {
+				alen++
+			}
+			if op.kind != '-' {
+				blen++
+			}
+		}
+		astart := hunk[0].aidx
+		if alen > 0 {
+			astart++
+		}
+		bstart := hunk[0].bidx
+		if blen > 0 {
+			bstart++
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", astart, alen, bstart, blen)
+		for _, op := range hunk {
+			fmt.Fprintf(&sb, "%c%s\n", op.kind, op.line)
+		}
+		i = stop
+	}
+	return sb.String()
+}
+
+// Sets entry tags by removing any existing tags, then adding the new tags.
+func setEntryTags(tx *sql.Tx, entryid int64, tags string) error {
+	s := "DELETE FROM entrytag WHERE entry_id = ?"
+	_, err := txexec(tx, s, entryid)
+	if err != nil {
+		return err
+	}
+
+	tt := strings.Split(tags, ",")
+	for _, t := range tt {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		s := "INSERT INTO entrytag (entry_id, tag) VALUES (?, ?)"
+		_, err := txexec(tx, s, entryid, t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns true if u can approve, reject or delete comments on entry e.
+func canModerateComments(u *User, e *Entry) bool {
+	if u == nil {
+		return false
+	}
+	return u.Userid == e.Userid || hasPerm(u, PermModerateAll)
+}
+
+// Name to show for comment author. Logged in users show their username.
+const commentSelect = `SELECT c.comment_id, c.entry_id, c.parent_id, c.user_id, IFNULL(u.username, IFNULL(c.name, '')), c.body, c.createdt, c.status 
+FROM comment c 
+LEFT OUTER JOIN user u ON u.user_id = c.user_id AND c.user_id <> 0 `
+
+func findComment(db *sql.DB, commentid int64) *Comment {
+	s := commentSelect + "WHERE c.comment_id = ?"
+	row := db.QueryRow(s, commentid)
+	var c Comment
+	err := row.Scan(&c.Commentid, &c.Entryid, &c.Parentid, &c.Userid, &c.Name, &c.Body, &c.Createdt, &c.Status)
+	if err != nil {
+		return nil
+	}
+	return &c
+}
+
+// Returns comments of entry in posting order. Pass empty qstatus for all comments.
+func findComments(db *sql.DB, entryid int64, qstatus string) ([]*Comment, error) {
+	s := commentSelect + "WHERE c.entry_id = ? AND (? = '' OR c.status = ?) ORDER BY c.comment_id"
+	return findCommentsWithParams(db, s, entryid, qstatus, qstatus)
+}
+
+// Returns comments awaiting moderation on entries that u can moderate.
+func findPendingComments(db *sql.DB, u *User) ([]*Comment, error) {
+	s := commentSelect + `INNER JOIN entry e ON e.entry_id = c.entry_id 
+WHERE c.status = ? AND (? OR e.user_id = ?) 
+ORDER BY c.comment_id`
+	return findCommentsWithParams(db, s, CommentPending, hasPerm(u, PermModerateAll), u.Userid)
+}
+func findCommentsWithParams(db *sql.DB, s string, qq ...interface{}) ([]*Comment, error) {
+	rows, err := db.Query(s, qq...)
+	if err != nil {
+		return nil, err
+	}
+	cc := []*Comment{}
+	for rows.Next() {
+		var c Comment
+		rows.Scan(&c.Commentid, &c.Entryid, &c.Parentid, &c.Userid, &c.Name, &c.Body, &c.Createdt, &c.Status)
+		cc = append(cc, &c)
+	}
+	return cc, nil
+}
+
+// Adds comment c to entry e by user u (nil for anonymous).
+// Comments from moderators are approved right away, all others wait for moderation.
+func createComment(db *sql.DB, c *Comment, e *Entry, u *User) (int64, error) {
+	c.Entryid = e.Entryid
+	c.Body = strings.TrimSpace(c.Body)
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Body == "" {
+		return 0, fmt.Errorf("comment is empty")
+	}
+	if u != nil {
+		c.Userid = u.Userid
+		c.Name = u.Username
+	} else {
+		c.Userid = 0
+		if c.Name == "" {
+			return 0, fmt.Errorf("enter your name")
+		}
+	}
+	if c.Parentid != 0 {
+		parent := findComment(db, c.Parentid)
+		if parent == nil || parent.Entryid != e.Entryid {
+			return 0, fmt.Errorf("reply to comment not found")
+		}
+	}
+	c.Status = CommentPending
+	if canModerateComments(u, e) {
+		c.Status = CommentApproved
+	}
+	c.Createdt = isodate(time.Now())
+
+	s := "INSERT INTO comment (entry_id, parent_id, user_id, name, body, createdt, status) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	result, err := sqlexec(db, s, c.Entryid, c.Parentid, c.Userid, c.Name, c.Body, c.Createdt, c.Status)
+	if err != nil {
+		return 0, err
+	}
+	commentid, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return commentid, nil
+}
+func editComment(db *sql.DB, c *Comment) error {
+	s := "UPDATE comment SET body = ?, status = ? WHERE comment_id = ?"
+	_, err := sqlexec(db, s, c.Body, c.Status, c.Commentid)
+	return err
+}
+func setCommentStatus(db *sql.DB, commentid int64, status string) error {
+	s := "UPDATE comment SET status = ? WHERE comment_id = ?"
+	_, err := sqlexec(db, s, status, commentid)
+	return err
+}
+
+// Deletes comment and its replies.
+func delComment(db *sql.DB, commentid int64) error {
+	s := "SELECT comment_id FROM comment WHERE parent_id = ?"
+	rows, err := db.Query(s, commentid)
+	if err != nil {
+		return err
+	}
+	var replyids []int64
+	for rows.Next() {
+		var replyid int64
+		rows.Scan(&replyid)
+		replyids = append(replyids, replyid)
+	}
+	rows.Close()
+	for _, replyid := range replyids {
+		err := delComment(db, replyid)
+		if err != nil {
+			return err
+		}
+	}
+
+	s = "DELETE FROM comment WHERE comment_id = ?"
+	_, err = sqlexec(db, s, commentid)
+	return err
+}
+
+func createFile(db *sql.DB, f *File) (int64, error) {
+	f.Filename = makeUniqueFilename(db, f.Filename)
+
+	release, err := putFileContents(db, f)
+	if err != nil {
+		return 0, err
+	}
+	var fileid int64
+	err = withWriteTx(db, func(tx *sql.Tx) error {
+		err := checkStorageQuota(tx, f.Userid, f.Size)
+		if err != nil {
+			return err
+		}
+		s := "INSERT INTO file (filename, title, blobkey, size, mimetype, width, height, createdt, user_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+		result, err := txexec(tx, s, f.Filename, f.Title, f.Blobkey, f.Size, f.Mimetype, f.Width, f.Height, f.Createdt, f.Userid)
+		if err != nil {
+			return err
+		}
+		fileid, err = result.LastInsertId()
+		return err
+	})
+	release()
+	if err != nil {
+		delUnusedBlob(db, f.Blobkey)
+		return 0, err
+	}
+	return fileid, nil
+}
+
+// Updates file. File contents are only replaced if f.Bytes is not empty.
+func editFile(db *sql.DB, f *File) error {
+	oldf := findFile(db, f.Fileid)
+	if oldf == nil {
+		return sql.ErrNoRows
+	}
+	if oldf.Filename != f.Filename {
+		f.Filename = makeUniqueFilename(db, f.Filename)
+	}
+	if len(f.Bytes) == 0 {
+		// Keep contents, but a new extension may change the mime type.
+		f.Blobkey = oldf.Blobkey
+		var err error
+		f.Mimetype, err = sniffFileContents(db, f)
+		if err != nil {
+			return err
+		}
+		s := "UPDATE file SET filename = ?, title = ?, mimetype = ? WHERE file_id = ?"
+		_, err = sqlexec(db, s, f.Filename, f.Title, f.Mimetype, f.Fileid)
+		return err
+	}
+
+	release, err := putFileContents(db, f)
+	if err != nil {
+		return err
+	}
+	err = withWriteTx(db, func(tx *sql.Tx) error {
+		err := checkStorageQuota(tx, oldf.Userid, f.Size-oldf.Size)
+		if err != nil {
+			return err
+		}
+		s := "UPDATE file SET filename = ?, title = ?, blobkey = ?, size = ?, mimetype = ?, width = ?, height = ?, bytes = NULL WHERE file_id = ?"
+		_, err = txexec(tx, s, f.Filename, f.Title, f.Blobkey, f.Size, f.Mimetype, f.Width, f.Height, f.Fileid)
+		return err
+	})
+	release()
+	if err != nil {
+		delUnusedBlob(db, f.Blobkey)
+		return err
+	}
+	if oldf.Blobkey != f.Blobkey {
+		err = delImageVariants(db, f.Fileid)
+		if err != nil {
+			return err
+		}
+		return delUnusedBlob(db, oldf.Blobkey)
+	}
+	return nil
+}
+func delFile(db *sql.DB, fileid int64) error {
+	f := findFile(db, fileid)
+	if f == nil {
+		return nil
+	}
+	err := delImageVariants(db, fileid)
+	if err != nil {
+		return err
+	}
+	s := `DELETE FROM file WHERE file_id = ?`
+	_, err = sqlexec(db, s, fileid)
+	if err != nil {
+		return err
+	}
+	return delUnusedBlob(db, f.Blobkey)
+}
+
+func dashboardHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	u, _ := validateLoginCookie(db, r)
+	if u == nil {
+		http.Error(w, "Must be logged in", 401)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	P := makeFprintf(w)
+	pp := getPageParams(r, db)
+	printHtmlOpen(P, pp.BlogTitle, []string{"/static/bundle.js", "/static/dashboard.js"})
+	printWideContainerOpen(P)
+	printHeading(P, u, pp)
+
+	printContainerClose(P)
+	printHtmlClose(P)
+}
+
+func apichangepwdHandler(db *sql.DB) http.HandlerFunc {
+	type Req struct {
+		Userid int64  `json:"userid"`
+		Pwd    string `json:"pwd"`
+		Newpwd string `json:"newpwd"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Use POST method", 401)
+			return
+		}
+
+		u := validateApiUser(db, r)
+		if u == nil {
+			http.Error(w, "Invalid user", 401)
+			return
+		}
+		bs, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			handleErr(w, err, "POST apichangepwdHandler")
+			return
+		}
+		var req Req
+		err = json.Unmarshal(bs, &req)
+		if err != nil {
+			handleErr(w, err, "POST apichangepwdHandler")
+			return
+		}
+		if req.Userid != u.Userid && !hasPerm(u, PermManageUsers) {
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+		err = edituser(db, req.Userid, req.Pwd, req.Newpwd, requestSessionToken(r))
+		if err == ErrLoginIncorrect {
+			http.Error(w, err.Error(), 401)
+			return
+		}
+		if err != nil {
+			handleErr(w, err, "POST apichangepwdHandler")
+			return
+		}
+	}
+}
+
+func apideluserHandler(db *sql.DB) http.HandlerFunc {
+	type Req struct {
+		Userid int64  `json:"userid"`
+		Pwd    string `json:"pwd"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Use POST method", 401)
+			return
+		}
+
+		u := validateApiUser(db, r)
+		if u == nil {
+			http.Error(w, "Invalid user", 401)
+			return
+		}
+		bs, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			handleErr(w, err, "POST apideluserHandler")
+			return
+		}
+		var req Req
+		err = json.Unmarshal(bs, &req)
+		if err != nil {
+			handleErr(w, err, "POST apideluserHandler")
+			return
+		}
+		if req.Userid != u.Userid && !hasPerm(u, PermManageUsers) {
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+		// Admin takes ownership of deleted user's entries and files.
+		admin := findFirstAdmin(db, req.Userid)
+		if admin == nil {
+			http.Error(w, "Can't delete the last admin", 401)
+			return
+		}
+
+		err = deluser(db, req.Userid, req.Pwd)
+		if err == ErrLoginIncorrect {
+			http.Error(w, err.Error(), 401)
+			return
+		}
+		if err != nil {
+			handleErr(w, err, "POST apideluserHandler")
+			return
+		}
+		err = transferUserEntries(db, req.Userid, admin.Userid)
+		if err != nil {
+			handleErr(w, err, "POST apideluserHandler")
+			return
+		}
+		err = transferUserFiles(db, req.Userid, admin.Userid)
+		if err != nil {
+			handleErr(w, err, "POST apideluserHandler")
+			return
+		}
+	}
+}
+
+func apiloginHandler(db *sql.DB) http.HandlerFunc {
+	type Req struct {
+		Userid int64  `json:"userid"`
+		Pwd    string `json:"pwd"`
+	}
+	type Resp struct {
+		Userid int64  `json:"userid"`
+		Sig    string `json:"sig"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Use POST method", 401)
+			return
+		}
+
+		bs, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			handleErr(w, err, "POST apiloginHandler")
+			return
+		}
+		var req Req
+		err = json.Unmarshal(bs, &req)
+		if err != nil {
+			handleErr(w, err, "POST apiloginHandler")
+			return
+		}
+
+		u, err := loginUserid(db, req.Userid, req.Pwd)
+		if err == ErrLoginIncorrect {
+			http.Error(w, err.Error(), 401)
+			return
+		}
+		if err != nil {
+			handleErr(w, err, "POST apiloginHandler")
+			return
+		}
+		token, sess, err := createSession(db, u, r)
+		if err != nil {
+			handleErr(w, err, "POST apiloginHandler")
+			return
+		}
+		setLoginCookie(w, r, u, token, sess)
+
+		var resp Resp
+		resp.Userid = u.Userid
+		resp.Sig = token
+
+		w.Header().Set("Content-Type", "application/json")
+		P := makeFprintf(w)
+		P("%s", jsonstr(resp))
+	}
+}
+
+func apilogoutHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Use POST", 401)
+			return
+		}
+
+		logout(db, r)
+		delLoginCookie(w)
+	}
+}
+
+// Ends the request's login session.
+func logout(db *sql.DB, r *http.Request) {
+	sess := findSessionByToken(db, requestSessionToken(r))
+	if sess == nil {
+		return
+	}
+	err := delSession(db, sess.Sessionid)
+	if err != nil {
+		logErr("logout", err)
+	}
+}
+
+// GET /api/users
+// Listing users requires the manageusers permission (admin).
+func apiusersHandler(db *sql.DB) http.HandlerFunc {
+	type Resp struct {
+		Userid   int64  `json:"userid"`
+		Username string `json:"username"`
+		Role     string `json:"role"`
+		Quota    int64  `json:"quota"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Use GET", 401)
+			return
+		}
+		u := validateApiUser(db, r)
+		if u == nil {
+			http.Error(w, "Invalid user", 401)
+			return
+		}
+		if !hasPerm(u, PermManageUsers) {
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+		uu, err := findUsers(db)
+		if handleDbErr(w, err, "GET apiusersHandler") {
+			return
+		}
+		resp := []Resp{}
+		for _, u := range uu {
+			resp = append(resp, Resp{u.Userid, u.Username, u.Role, u.Quota})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		P := makeFprintf(w)
+		P("%s", jsonstr(resp))
+	}
+}
+
+// GET /api/usage
+// GET /api/usage?userid=2
+// Returns storage used by user's files, their quota (0 is unlimited) and the
+// upload limits. Other users' usage requires the manageusers permission.
+func apiusageHandler(db *sql.DB) http.HandlerFunc {
+	type Resp struct {
+		Userid        int64 `json:"userid"`
+		Used          int64 `json:"used"`
+		Quota         int64 `json:"quota"`
+		MaxFileSize   int64 `json:"maxfilesize"`
+		MaxUploadSize int64 `json:"maxuploadsize"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Use GET", 401)
+			return
+		}
+		u := validateApiUser(db, r)
+		if u == nil {
+			http.Error(w, "Invalid user", 401)
+			return
+		}
+		quser := u
+		quserid := idtoi(r.FormValue("userid"))
+		if quserid != 0 && quserid != u.Userid {
+			if !hasPerm(u, PermManageUsers) {
+				http.Error(w, "Not authorized", 401)
+				return
+			}
+			quser = findUserById(db, quserid)
+			if quser == nil {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+		}
+		used, err := userStorageUsed(db, quser.Userid)
+		if handleDbErr(w, err, "GET apiusageHandler") {
+			return
+		}
+		resp := Resp{quser.Userid, used, userStorageQuota(quser), maxFileSize, maxUploadSize}
+
+		w.Header().Set("Content-Type", "application/json")
+		P := makeFprintf(w)
+		P("%s", jsonstr(resp))
+	}
+}
+
+// POST /api/userquota {"userid": 2, "quota": 1073741824}
+// Sets user's storage quota in bytes. 0 uses the default quota.
+func apiuserquotaHandler(db *sql.DB) http.HandlerFunc {
+	type Req struct {
+		Userid int64 `json:"userid"`
+		Quota  int64 `json:"quota"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Use POST method", 401)
+			return
+		}
+		u := validateApiUser(db, r)
+		if u == nil {
+			http.Error(w, "Invalid user", 401)
+			return
+		}
+		if !hasPerm(u, PermManageUsers) {
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+		bs, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			handleErr(w, err, "POST apiuserquotaHandler")
+			return
+		}
+		var req Req
+		err = json.Unmarshal(bs, &req)
+		if err != nil {
+			handleErr(w, err, "POST apiuserquotaHandler")
+			return
+		}
+		if req.Quota < 0 {
+			http.Error(w, "Invalid quota", 400)
+			return
+		}
+		if findUserById(db, req.Userid) == nil {
+			http.Error(w, "User not found", 400)
+			return
+		}
+		s := "UPDATE user SET quota = ? WHERE user_id = ?"
+		_, err = sqlexec(db, s, req.Quota, req.Userid)
+		if handleDbErr(w, err, "POST apiuserquotaHandler") {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		P := makeFprintf(w)
+		P("%s", jsonstr(req))
+	}
+}
+
+// POST /api/userrole {"userid": 2, "role": "editor"}
+// Roles: admin, editor, author, contributor. The last admin can't be demoted.
+func apiuserroleHandler(db *sql.DB) http.HandlerFunc {
+	type Req struct {
+		Userid int64  `json:"userid"`
+		Role   string `json:"role"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Use POST method", 401)
+			return
+		}
+		u := validateApiUser(db, r)
+		if u == nil {
+			http.Error(w, "Invalid user", 401)
+			return
+		}
+		if !hasPerm(u, PermManageUsers) {
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+		bs, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			handleErr(w, err, "POST apiuserroleHandler")
+			return
+		}
+		var req Req
+		err = json.Unmarshal(bs, &req)
+		if err != nil {
+			handleErr(w, err, "POST apiuserroleHandler")
+			return
+		}
+		err = setUserRole(db, req.Userid, req.Role)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		P := makeFprintf(w)
+		P("%s", jsonstr(req))
+	}
+}
+
+// GET /api/tokens
+// POST /api/tokens {"name": "ci", "scopes": "entries:write,files:write"}
+// DELETE /api/tokens?id=123
+// Api tokens can only be managed from a login session, not with another api token.
+func apitokensHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := validateSession(db, requestSessionToken(r))
+		if u == nil {
+			http.Error(w, "Invalid user", 401)
+			return
+		}
+
+		if r.Method == "GET" {
+			tt, err := findUserApiTokens(db, u.Userid)
+			if handleDbErr(w, err, "GET apitokensHandler") {
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			P := makeFprintf(w)
+			P("%s", jsonstr(tt))
+			return
+		} else if r.Method == "POST" {
+			bs, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				handleErr(w, err, "POST apitokensHandler")
+				return
+			}
+			var t ApiToken
+			err = json.Unmarshal(bs, &t)
+			if err != nil {
+				handleErr(w, err, "POST apitokensHandler")
+				return
+			}
+			t.Userid = u.Userid
+			newid, err := createApiToken(db, &t)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			t.Tokenid = newid
+
+			w.Header().Set("Content-Type", "application/json")
+			P := makeFprintf(w)
+			P("%s", jsonstr(t))
+			return
+		} else if r.Method == "DELETE" {
+			err := delApiToken(db, u.Userid, idtoi(r.FormValue("id")))
+			if err != nil {
+				handleErr(w, err, "DEL apitokensHandler")
+			}
+			return
+		}
+
+		http.Error(w, "Use GET/POST/DELETE", 401)
+	}
+}
+
+// GET /api/sessions
+// DELETE /api/sessions?id=123
+// DELETE /api/sessions?all=1 (all sessions except the current one)
+func apisessionsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := requestSessionToken(r)
+		u := validateSession(db, token)
+		if u == nil {
+			http.Error(w, "Invalid user", 401)
+			return
+		}
+		cursess := findSessionByToken(db, token)
+
+		if r.Method == "GET" {
+			ss, err := findUserSessions(db, u.Userid)
+			if handleDbErr(w, err, "GET apisessionsHandler") {
+				return
+			}
+			for _, sess := range ss {
+				if cursess != nil && sess.Sessionid == cursess.Sessionid {
+					sess.Current = true
+				}
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			P := makeFprintf(w)
+			P("%s", jsonstr(ss))
+			return
+		} else if r.Method == "DELETE" {
+			if r.FormValue("all") != "" {
+				err := delUserSessions(db, u.Userid, token)
+				if err != nil {
+					handleErr(w, err, "DEL apisessionsHandler")
+				}
+				return
+			}
+
+			qid := idtoi(r.FormValue("id"))
+			ss, err := findUserSessions(db, u.Userid)
+			if handleDbErr(w, err, "DEL apisessionsHandler") {
+				return
+			}
+			for _, sess := range ss {
+				if sess.Sessionid != qid {
+					continue
+				}
+				err := delSession(db, qid)
+				if err != nil {
+					handleErr(w, err, "DEL apisessionsHandler")
+				}
+				return
+			}
+			http.Error(w, "Not found.", 404)
+			return
+		}
+
+		http.Error(w, "Use GET/DELETE", 401)
+	}
+}
+
+// GET /api/entry?id=123
+// DELETE /api/entry?id=123
+// POST /api/entry {...}
+// PUT /api/entry {...}
+func apientryHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			qid := idtoi(r.FormValue("id"))
+			qfmt := r.FormValue("fmt")
+			if qid == 0 {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+
+			e := findEntry(db, qid)
+			if e == nil || !canViewEntry(validateApiUser(db, r), e) {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			P := makeFprintf(w)
+			if qfmt == "html" {
+				printViewEntry(P, db, e)
+				return
+			}
+			P("%s", jsonstr(e))
+			return
+		} else if r.Method == "POST" {
+			u := validateApiUser(db, r)
+			if u == nil {
+				http.Error(w, "Invalid user", 401)
+				return
+			}
+			bs, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				handleErr(w, err, "POST apientryHandler")
+				return
+			}
+			var e Entry
+			err = json.Unmarshal(bs, &e)
+			if err != nil {
+				handleErr(w, err, "POST apientryHandler")
+				return
+			}
+			e.Userid = u.Userid
+			e.Createdt = isodate(clock.Now())
+			err = validateEntryStatus(&e)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			if !canSetEntryStatus(u, &e) {
+				http.Error(w, "Not authorized to publish", 401)
+				return
+			}
+			newid, err := createEntry(db, &e, true)
+			if err != nil {
+				handleErr(w, err, "POST apientryHandler")
+				return
+			}
+			e.Entryid = newid
+			go func() {
+				err := deliverPublishEvents(db)
+				if err != nil {
+					logErr("deliverPublishEvents", err)
+				}
+			}()
+
+			w.Header().Set("Content-Type", "application/json")
+			P := makeFprintf(w)
+			P("%s", jsonstr(e))
+			return
+		} else if r.Method == "PUT" {
+			u := validateApiUser(db, r)
+			if u == nil {
+				http.Error(w, "Invalid user", 401)
+				return
+			}
+			bs, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				handleErr(w, err, "PUT apientryHandler")
+				return
+			}
+			var e Entry
+			err = json.Unmarshal(bs, &e)
+			if err != nil {
+				handleErr(w, err, "PUT apientryHandler")
+				return
+			}
+			olde := findEntry(db, e.Entryid)
+			if olde == nil {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+			if !canEditEntry(u, olde) {
+				http.Error(w, "Not authorized", 401)
+				return
+			}
+			e.Userid = olde.Userid
+			e.Username = olde.Username
+			// Status is optional on PUT, leave it unchanged if missing.
+			if e.Status == "" {
+				e.Status = olde.Status
+				e.Publishat = olde.Publishat
+			}
+			err = validateEntryStatus(&e)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			if !canSetEntryStatus(u, &e) {
+				http.Error(w, "Not authorized to publish, save as draft", 401)
+				return
+			}
+			err = editEntry(db, &e, u.Userid)
+			if err != nil {
+				handleErr(w, err, "PUT apientryHandler")
+				return
+			}
+			go func() {
+				err := deliverPublishEvents(db)
+				if err != nil {
+					logErr("deliverPublishEvents", err)
+				}
+			}()
+
+			w.Header().Set("Content-Type", "application/json")
+			P := makeFprintf(w)
+			P("%s", jsonstr(e))
+			return
+		} else if r.Method == "DELETE" {
+			u := validateApiUser(db, r)
+			if u == nil {
+				http.Error(w, "Invalid user", 401)
+				return
+			}
+			qid := idtoi(r.FormValue("id"))
+			if qid == 0 {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+
+			e := findEntry(db, qid)
+			if e == nil {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+			if !canEditEntry(u, e) {
+				http.Error(w, "Not authorized", 401)
+				return
+			}
+
+			err := delEntry(db, qid)
+			if err != nil {
+				handleErr(w, err, "DEL apientryHandler")
+				return
+			}
+			return
+		}
+
+		http.Error(w, "Use GET/POST/PUT/DELETE", 401)
+	}
+}
+
+// Returns entry if u is allowed to manage its revisions (anyone who can edit it).
+// Writes the http error and returns nil otherwise.
+func findEntryForRevisions(w http.ResponseWriter, r *http.Request, db *sql.DB, u *User) *Entry {
+	if u == nil {
+		http.Error(w, "Invalid user", 401)
+		return nil
+	}
+	qid := idtoi(r.FormValue("id"))
+	if qid == 0 {
+		http.Error(w, "Not found.", 404)
+		return nil
+	}
+	e := findEntry(db, qid)
+	if e == nil {
+		http.Error(w, "Not found.", 404)
+		return nil
+	}
+	if !canEditEntry(u, e) {
+		http.Error(w, "Not authorized", 401)
+		return nil
+	}
+	return e
+}
+
+// GET /api/entry/revisions?id=123
+func apientryrevisionsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Use GET method", 401)
+			return
+		}
+		e := findEntryForRevisions(w, r, db, validateApiUser(db, r))
+		if e == nil {
+			return
+		}
+		rr, err := findEntryRevisions(db, e.Entryid)
+		if handleDbErr(w, err, "apientryrevisionsHandler") {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		P := makeFprintf(w)
+		P("%s", jsonstr(rr))
+	}
+}
+
+// GET /api/entry/diff?id=123&from=1&to=3
+// Returns unified diff between two revisions. If to is not specified,
+// the latest revision is used.
+func apientrydiffHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Use GET method", 401)
+			return
+		}
+		e := findEntryForRevisions(w, r, db, validateApiUser(db, r))
+		if e == nil {
+			return
+		}
+		qfrom := idtoi(r.FormValue("from"))
+		qto := idtoi(r.FormValue("to"))
+		if qto == 0 {
+			qto = findLatestEntryRevision(db, e.Entryid)
+		}
+		if qfrom == 0 {
+			qfrom = qto - 1
+		}
+		erfrom := findEntryRevision(db, e.Entryid, qfrom)
+		erto := findEntryRevision(db, e.Entryid, qto)
+		if erfrom == nil || erto == nil {
+			http.Error(w, "Revision not found.", 404)
+			return
+		}
+
+		aname := fmt.Sprintf("rev %d (%s, %s)", erfrom.Rev, erfrom.Username, erfrom.Createdt)
+		bname := fmt.Sprintf("rev %d (%s, %s)", erto.Rev, erto.Username, erto.Createdt)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		P := makeFprintf(w)
+		P("%s", unifiedDiff(aname, bname, revisionText(erfrom), revisionText(erto)))
+	}
+}
+
+// POST /api/entry/restore?id=123&rev=2
+// Restores title, body and tags from revision. The restore is saved as a new revision.
+// Restores by users who can't publish are saved as drafts.
+func apientryrestoreHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Use POST method", 401)
+			return
+		}
+		u := validateApiUser(db, r)
+		e := findEntryForRevisions(w, r, db, u)
+		if e == nil {
+			return
+		}
+		er := findEntryRevision(db, e.Entryid, idtoi(r.FormValue("rev")))
+		if er == nil {
+			http.Error(w, "Revision not found.", 404)
+			return
+		}
+		e.Title = er.Title
+		e.Body = er.Body
+		e.Tags = er.Tags
+		if !canSetEntryStatus(u, e) {
+			e.Status = EntryDraft
+			e.Publishat = ""
+		}
+		err := editEntry(db, e, u.Userid)
+		if err != nil {
+			handleErr(w, err, "POST apientryrestoreHandler")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		P := makeFprintf(w)
+		P("%s", jsonstr(e))
+	}
+}
+
+func printViewEntry(P PrintFunc, db *sql.DB, e *Entry) {
+	P("<h1 class=\"text-2xl mb-2\">%s</h1>\n", escape(e.Title))
+	if e.Username != "" {
+		P("<p class=\"mb-4 text-sm\">Posted on \n")
+		P("    <span class=\"italic\">%s</span> by %s\n", formatdate(e.Createdt), e.Username)
+		P("</p>\n")
+	} else {
+		P("<p class=\"mb-4 text-sm\">Posted on <span class=\"italic\">%s</span></p>\n", formatdate(e.Createdt))
+	}
+	P("<div class=\"content\">\n")
+	P("%s\n", parseMarkdown(db, e.Body))
+	P("</div>\n")
+}
+
+// GET /api/entries
+// Unpublished entries are only returned to users who can edit them.
+// GET /api/entries?userid=2
+// GET /api/entries?tag=abc
+// GET /api/entries?q=abc
+// GET /api/entries?limit=10
+// GET /api/entries?limit=10&offset=20
+// GET /api/entries?limit=10&before=123
+// Returns {entries, total, nextcursor} where nextcursor is the 'before' value
+// to get the next page, or 0 if there are no more entries.
+func apientriesHandler(db *sql.DB) http.HandlerFunc {
+	type Resp struct {
+		Entries    []*Entry `json:"entries"`
+		Total      int      `json:"total"`
+		Limit      int      `json:"limit"`
+		Offset     int      `json:"offset"`
+		Nextcursor int64    `json:"nextcursor"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ee []*Entry
+		var total int
+		var err error
+
+		quserid := idtoi(r.FormValue("userid"))
+		qtag := r.FormValue("tag")
+		qlimit := atoi(r.FormValue("limit"))
+		qoffset := atoi(r.FormValue("offset"))
+		qbefore := idtoi(r.FormValue("before"))
+
+		u := validateApiUser(db, r)
+
+		q := strings.TrimSpace(r.FormValue("q"))
+		if q != "" {
+			ee, err = searchEntries(db, u, quserid, q, qlimit, qoffset)
+			if err == nil {
+				total, err = countSearchEntries(db, u, quserid, q)
+			}
+		} else {
+			ee, err = findEntries(db, u, quserid, qtag, qbefore, qlimit, qoffset)
+			if err == nil {
+				total, err = countEntries(db, u, quserid, qtag)
+			}
+		}
+		if err != nil {
+			handleErr(w, err, "apientriesHandler")
+			return
+		}
+
+		var resp Resp
+		resp.Entries = ee
+		resp.Total = total
+		resp.Limit = qlimit
+		resp.Offset = qoffset
+		// Search results are ordered by relevance so only offset paging applies.
+		if q == "" && qlimit > 0 && len(ee) == qlimit {
+			last := ee[len(ee)-1].Entryid
+			more, err := findEntries(db, u, quserid, qtag, last, 1, 0)
+			if err == nil && len(more) > 0 {
+				resp.Nextcursor = last
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		P := makeFprintf(w)
+		P("%s", jsonstr(resp))
+	}
+}
+
+// GET /api/comments?entryid=123
+// GET /api/comments?status=pending
+// DELETE /api/comments?id=123
+// POST /api/comments {...}
+// PUT /api/comments {...}
+// Public requests only see approved comments. Entry author and moderators see all
+// comments of the entry, and status=pending returns their moderation queue.
+func apicommentsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			u := validateApiUser(db, r)
+			var cc []*Comment
+			var err error
+
+			qentryid := idtoi(r.FormValue("entryid"))
+			qstatus := r.FormValue("status")
+			if qentryid == 0 {
+				if qstatus != CommentPending || u == nil {
+					http.Error(w, "Specify entryid or status=pending", 401)
+					return
+				}
+				cc, err = findPendingComments(db, u)
+			} else {
+				e := findEntry(db, qentryid)
+				if e == nil || !canViewEntry(u, e) {
+					http.Error(w, "Not found.", 404)
+					return
+				}
+				if !canModerateComments(u, e) {
+					qstatus = CommentApproved
+				}
+				cc, err = findComments(db, qentryid, qstatus)
+			}
+			if handleDbErr(w, err, "GET apicommentsHandler") {
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			P := makeFprintf(w)
+			P("%s", jsonstr(cc))
+			return
+		} else if r.Method == "POST" {
+			u := validateApiUser(db, r)
+			bs, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				handleErr(w, err, "POST apicommentsHandler")
+				return
+			}
+			var c Comment
+			err = json.Unmarshal(bs, &c)
+			if err != nil {
+				handleErr(w, err, "POST apicommentsHandler")
+				return
+			}
+			e := findEntry(db, c.Entryid)
+			if e == nil || !canViewEntry(u, e) {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+			newid, err := createComment(db, &c, e, u)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			c.Commentid = newid
+
+			w.Header().Set("Content-Type", "application/json")
+			P := makeFprintf(w)
+			P("%s", jsonstr(c))
+			return
+		} else if r.Method == "PUT" {
+			u := validateApiUser(db, r)
+			if u == nil {
+				http.Error(w, "Invalid user", 401)
+				return
+			}
+			bs, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				handleErr(w, err, "PUT apicommentsHandler")
+				return
+			}
+			var reqc Comment
+			err = json.Unmarshal(bs, &reqc)
+			if err != nil {
+				handleErr(w, err, "PUT apicommentsHandler")
+				return
+			}
+			c := findComment(db, reqc.Commentid)
+			if c == nil {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+			e := findEntry(db, c.Entryid)
+			if e == nil {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+			if c.Userid != u.Userid && !canModerateComments(u, e) {
+				http.Error(w, "Not authorized", 401)
+				return
+			}
+			c.Body = strings.TrimSpace(reqc.Body)
+			if c.Body == "" {
+				http.Error(w, "comment is empty", 400)
+				return
+			}
+			// Edits by the commenter need to be approved again.
+			if !canModerateComments(u, e) {
+				c.Status = CommentPending
+			}
+			err = editComment(db, c)
+			if err != nil {
+				handleErr(w, err, "PUT apicommentsHandler")
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			P := makeFprintf(w)
+			P("%s", jsonstr(c))
+			return
+		} else if r.Method == "DELETE" {
+			u := validateApiUser(db, r)
+			if u == nil {
+				http.Error(w, "Invalid user", 401)
+				return
+			}
+			c := findComment(db, idtoi(r.FormValue("id")))
+			if c == nil {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+			e := findEntry(db, c.Entryid)
+			if e == nil {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+			if c.Userid != u.Userid && !canModerateComments(u, e) {
+				http.Error(w, "Not authorized", 401)
+				return
+			}
+			err := delComment(db, c.Commentid)
+			if err != nil {
+				handleErr(w, err, "DEL apicommentsHandler")
+				return
+			}
+			return
+		}
+
+		http.Error(w, "Use GET/POST/PUT/DELETE", 401)
+	}
+}
+
+// POST /api/comments/approve?id=123
+// POST /api/comments/reject?id=123
+func apimoderatecommentHandler(db *sql.DB, status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Use POST method", 401)
+			return
+		}
+		u := validateApiUser(db, r)
+		if u == nil {
+			http.Error(w, "Invalid user", 401)
+			return
+		}
+		c := findComment(db, idtoi(r.FormValue("id")))
+		if c == nil {
+			http.Error(w, "Not found.", 404)
+			return
+		}
+		e := findEntry(db, c.Entryid)
+		if e == nil {
+			http.Error(w, "Not found.", 404)
+			return
+		}
+		if !canModerateComments(u, e) {
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+		err := setCommentStatus(db, c.Commentid, status)
+		if err != nil {
+			handleErr(w, err, "POST apimoderatecommentHandler")
+			return
+		}
+		c.Status = status
+
+		w.Header().Set("Content-Type", "application/json")
+		P := makeFprintf(w)
+		P("%s", jsonstr(c))
+	}
+}
+
+// If another file has the same filename, add a --n to make unique.
+// Ex. "Abc File", "Abc File--1", "Abc File--2", etc.
+func makeUniqueFilename(db *sql.DB, filename string) string {
+	uniqueFilename := filename
+	for i := 1; i < 100; i++ {
+		f := findFileByFilename(db, uniqueFilename)
+		if f == nil {
+			return uniqueFilename
+		}
+		ext := filepath.Ext(filename)
+		base := strings.TrimSuffix(filename, ext)
+		uniqueFilename = fmt.Sprintf("%s--%d%s", base, i, ext)
+	}
+
+	// If code reached this point, that means we're at (100) which is very unusual.
+	// Rather than risk an overly long loop, let's just cap it off at (100).
+	return uniqueFilename
+}
+
+func baseFilename(filename string) string {
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	return base
+}
+
+func apiuploadfilesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Use POST method", 401)
+			return
+		}
+
+		u := validateApiUser(db, r)
+		if u == nil {
+			http.Error(w, "Invalid user", 401)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		err := r.ParseMultipartForm(maxUploadMemory)
+		if isMaxBytesError(err) {
+			http.Error(w, fmt.Sprintf("Upload is larger than %d bytes", maxUploadSize), 413)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		hh := r.MultipartForm.File["files"]
+
+		// Check limits before storing any of the files.
+		var total int64
+		for _, h := range hh {
+			if h.Size > maxFileSize {
+				http.Error(w, fmt.Sprintf("File '%s' is larger than %d bytes", h.Filename, maxFileSize), 413)
+				return
+			}
+			total += h.Size
+		}
+		err = checkStorageQuota(db, u.Userid, total)
+		if err == ErrQuotaExceeded {
+			http.Error(w, err.Error(), 413)
+			return
+		}
+		if err != nil {
+			handleErr(w, err, "apiuploadfilesHandler")
+			return
+		}
+
+		for _, h := range hh {
+			f, err := h.Open()
+			if err != nil {
+				handleErr(w, err, "apiuploadfilesHandler")
+				return
+			}
+			defer f.Close()
+
+			var file File
+			bs, err := ioutil.ReadAll(f)
+			if err != nil {
+				handleErr(w, err, "apiuploadfilesHandler")
+				return
+			}
+			file.Filename = h.Filename
+			file.Title = baseFilename(h.Filename)
+			file.Bytes = bs
+			file.Createdt = isodate(time.Now())
+			file.Userid = u.Userid
+			_, err = createFile(db, &file)
+			if err == ErrQuotaExceeded {
+				http.Error(w, err.Error(), 413)
+				return
+			}
+			if err != nil {
+				handleErr(w, err, "apiuploadfilesHandler")
+				return
+			}
+		}
+	}
+}
+
+// Largest json body of /api/file requests. Contents are base64 encoded.
+func maxFileJsonSize() int64 {
+	return maxFileSize/3*4 + 64<<10
+}
+
+// Checks file size and user's quota of file contents in f.Bytes, which
+// replace oldsize bytes. Writes 413 error and returns false if over limits.
+func checkFileUploadLimits(w http.ResponseWriter, db *sql.DB, u *User, f *File, oldsize int64) bool {
+	if len(f.Bytes) == 0 {
+		return true
+	}
+	if int64(len(f.Bytes)) > maxFileSize {
+		http.Error(w, fmt.Sprintf("File is larger than %d bytes", maxFileSize), 413)
+		return false
+	}
+	err := checkStorageQuota(db, u.Userid, int64(len(f.Bytes))-oldsize)
+	if err == ErrQuotaExceeded {
+		http.Error(w, err.Error(), 413)
+		return false
+	}
+	if err != nil {
+		handleErr(w, err, "checkFileUploadLimits")
+		return false
+	}
+	return true
+}
+
+// GET /api/file?id=123
+// DELETE /api/file?id=123
+// POST /api/file {...}
+// PUT /api/file {...}
+func apifileHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			qid := idtoi(r.FormValue("id"))
+			if qid == 0 {
+				http.Error(w, "Specify file id (id=nnn)", 401)
+				return
+			}
+			f := findFile(db, qid)
+			if f == nil {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+			f.Url = fileurl(f)
+
+			w.Header().Set("Content-Type", "application/json")
+			P := makeFprintf(w)
+			P("%s", jsonstr(f))
+			return
+		} else if r.Method == "POST" {
+			u := validateApiUser(db, r)
+			if u == nil {
+				http.Error(w, "Invalid user", 401)
+				return
+			}
+			bs, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxFileJsonSize()))
+			if isMaxBytesError(err) {
+				http.Error(w, fmt.Sprintf("File is larger than %d bytes", maxFileSize), 413)
+				return
+			}
+			if err != nil {
+				handleErr(w, err, "POST apientryHandler")
+				return
+			}
+			var f File
+			err = json.Unmarshal(bs, &f)
+			if err != nil {
+				handleErr(w, err, "POST apifileHandler")
+				return
+			}
+			if !checkFileUploadLimits(w, db, u, &f, 0) {
+				return
+			}
+			f.Userid = u.Userid
+			f.Createdt = isodate(time.Now())
+			newid, err := createFile(db, &f)
+			if err == ErrQuotaExceeded {
+				http.Error(w, err.Error(), 413)
+				return
+			}
+			if err != nil {
+				handleErr(w, err, "POST apifileHandler")
+				return
+			}
+			f.Fileid = newid
+
+			w.Header().Set("Content-Type", "application/json")
+			P := makeFprintf(w)
+			P("%s", jsonstr(f))
+			return
+		} else if r.Method == "PUT" {
+			u := validateApiUser(db, r)
+			if u == nil {
+				http.Error(w, "Invalid user", 401)
+				return
+			}
+			bs, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxFileJsonSize()))
+			if isMaxBytesError(err) {
+				http.Error(w, fmt.Sprintf("File is larger than %d bytes", maxFileSize), 413)
+				return
+			}
+			if err != nil {
+				handleErr(w, err, "PUT apifileHandler 2")
+				return
+			}
+			var f File
+			err = json.Unmarshal(bs, &f)
+			if err != nil {
+				handleErr(w, err, "PUT apifileHandler 3")
+				return
+			}
+			oldf := findFile(db, f.Fileid)
+			if oldf == nil {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+			if !canEditFile(u, oldf) {
+				http.Error(w, "Not authorized", 401)
+				return
+			}
+			// Replaced contents count against the file owner's quota.
+			owner := findUserById(db, oldf.Userid)
+			if owner == nil {
+				owner = u
+			}
+			if !checkFileUploadLimits(w, db, owner, &f, oldf.Size) {
+				return
+			}
+			f.Userid = oldf.Userid
+			err = editFile(db, &f)
+			if err == ErrQuotaExceeded {
+				http.Error(w, err.Error(), 413)
+				return
+			}
+			if err != nil {
+				handleErr(w, err, "PUT apifileHandler 4")
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			P := makeFprintf(w)
+			P("%s", jsonstr(f))
+			return
+		} else if r.Method == "DELETE" {
+			u := validateApiUser(db, r)
+			if u == nil {
+				http.Error(w, "Invalid user", 401)
+				return
+			}
+			qid := idtoi(r.FormValue("id"))
+			if qid == 0 {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+
+			f := findFile(db, qid)
+			if f == nil {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+			if !canEditFile(u, f) {
+				http.Error(w, "Not authorized", 401)
+				return
+			}
+
+			err := delFile(db, qid)
+			if err != nil {
+				handleErr(w, err, "DEL apifileHandler")
+				return
+			}
+			return
+		}
+
+		http.Error(w, "Use GET/POST/PUT/DELETE", 401)
+	}
+}
+
+func apifilesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ff []*File
+		var err error
+
+		quserid := idtoi(r.FormValue("userid"))
+		qfilename := r.FormValue("filename")
+		qlimit := atoi(r.FormValue("limit"))
+		qoffset := atoi(r.FormValue("offset"))
+		qfiletype := r.FormValue("filetype")
+
+		if qfiletype == "image" {
+			ff, err = findImageFiles(db, quserid, qfilename, qlimit, qoffset)
+		} else if qfiletype == "attachment" {
+			ff, err = findAttachmentFiles(db, quserid, qfilename, qlimit, qoffset)
+		} else {
+			ff, err = findFiles(db, quserid, qfilename, qlimit, qoffset)
+		}
+		if err != nil {
+			handleErr(w, err, "apifilesHandler")
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		P := makeFprintf(w)
+		P("%s", jsonstr(ff))
+	}
+}
+
+// GET /api/site
+// POST /api/site {...}
+func apisiteHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			site := findSite(db)
+			if site == nil {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+			site.About = findSiteAbout(db)
+
+			w.Header().Set("Content-Type", "application/json")
+			P := makeFprintf(w)
+			P("%s", jsonstr(site))
+			return
+		} else if r.Method == "POST" || r.Method == "PUT" {
+			u := validateApiUser(db, r)
+			if u == nil {
+				http.Error(w, "Invalid user", 401)
+				return
+			}
+			if !hasPerm(u, PermManageSite) {
+				http.Error(w, "Not authorized", 401)
+				return
+			}
+			bs, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				handleErr(w, err, "POST apisiteHandler")
+				return
+			}
+			var site Site
+			err = json.Unmarshal(bs, &site)
+			site.Siteid = 1
+			if err != nil {
+				handleErr(w, err, "POST apisiteHandler")
+				return
+			}
+			err = createSite(db, &site)
+			if err != nil {
+				handleErr(w, err, "POST apisiteHandler")
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			P := makeFprintf(w)
+			P("%s", jsonstr(site))
+			return
+		}
+
+		http.Error(w, "Use GET/PUT/POST", 401)
+	}
+}
+
+// GET /api/usersettings?id=123
+// POST /api/usersettings {...}
+func apiusersettingsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			qid := idtoi(r.FormValue("id"))
+			if qid == 0 {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+
+			us := findUserSettingsById(db, qid)
+			if us == nil {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+			us.BlogAbout = findUserAboutById(db, qid)
+
+			w.Header().Set("Content-Type", "application/json")
+			P := makeFprintf(w)
+			P("%s", jsonstr(us))
+			return
+		} else if r.Method == "POST" || r.Method == "PUT" {
+			u := validateApiUser(db, r)
+			if u == nil {
+				http.Error(w, "Invalid user", 401)
+				return
+			}
+			bs, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				handleErr(w, err, "POST apiusersettingsHandler")
+				return
+			}
+			var us UserSettings
+			err = json.Unmarshal(bs, &us)
+			if err != nil {
+				handleErr(w, err, "POST apiusersettingsHandler")
+				return
+			}
+			us.Userid = u.Userid
+			err = createUserSettings(db, &us)
+			if err != nil {
+				handleErr(w, err, "POST apiusersettingsHandler")
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			P := makeFprintf(w)
+			P("%s", jsonstr(us))
+			return
+		}
+
+		http.Error(w, "Use GET/PUT/POST", 401)
+	}
+}
+
+// POST /api/import/ multipart form with:
+//
+//	file: WordPress export .xml, or .zip of Hugo/Jekyll markdown files
+//	userid: (optional) owner of entries whose author isn't a user here,
+//	        defaults to the logged in admin
+//
+// Returns import counts and warnings.
+func apiimportHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Use POST method", 401)
+			return
+		}
+		u := validateApiUser(db, r)
+		if u == nil {
+			http.Error(w, "Invalid user", 401)
+			return
+		}
+		if !hasPerm(u, PermManageSite) {
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		err := r.ParseMultipartForm(maxUploadMemory)
+		if isMaxBytesError(err) {
+			http.Error(w, fmt.Sprintf("Upload is larger than %d bytes", maxUploadSize), 413)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		defaultu := u
+		if quserid := idtoi(r.FormValue("userid")); quserid != 0 {
+			defaultu = findUserById(db, quserid)
+			if defaultu == nil {
+				http.Error(w, "User not found", 401)
+				return
+			}
+		}
+		f, h, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Specify file to import", 400)
+			return
+		}
+		defer f.Close()
+
+		res, err := importFile(db, f, h.Size, h.Filename, defaultu)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		P := makeFprintf(w)
+		P("%s", jsonstr(res))
+	}
+}
+
+// GET /api/export?userid=123
+// Returns zip of user's entries as markdown, files and about page, so users
+// can keep a copy of their writing. Users can export their own blog, admins
+// any user's.
+func apiexportHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Use GET method", 401)
+			return
+		}
+		u := validateApiUser(db, r)
+		if u == nil {
+			http.Error(w, "Invalid user", 401)
+			return
+		}
+		quserid := idtoi(r.FormValue("userid"))
+		if quserid == 0 {
+			quserid = u.Userid
+		}
+		if quserid != u.Userid && !hasPerm(u, PermManageUsers) {
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+		eu := findUserById(db, quserid)
+		if eu == nil {
+			http.Error(w, "User not found", 404)
+			return
+		}
+
+		filename := fmt.Sprintf("%s-freeblog-%s.zip", safeFilename(eu.Username), time.Now().Format("20060102"))
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		zw := zip.NewWriter(w)
+		err := writeUserExport(db, zw, eu)
+		if err == nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			// Response has started, the client gets a truncated zip.
+			logErr("apiexportHandler", err)
+		}
+	}
+}
+
+var fileLinkRe = regexp.MustCompile(`/\?page=file(?:&(?:amp;)?\w+=[^&\s"'()<>\[\]]*)+`)
+
+// Replaces links to exported files, ex. "/?page=file&id=12&w=320", with
+// their path in the export zip, ex. "../files/12/photo.jpg" with prefix "../".
+// Links to resized copies point to the original file.
+func relinkExportFiles(db *sql.DB, body, prefix string, exported map[int64]bool) string {
+	return fileLinkRe.ReplaceAllStringFunc(body, func(link string) string {
+		q, err := url.ParseQuery(strings.ReplaceAll(link[2:], "&amp;", "&"))
+		if err != nil {
+			return link
+		}
+		var f *File
+		if qid := idtoi(q.Get("id")); qid > 0 {
+			f = findFile(db, qid)
+		} else if q.Get("filename") != "" {
+			f = findFileByFilename(db, q.Get("filename"))
+		}
+		if f == nil || !exported[f.Fileid] {
+			return link
+		}
+		return fmt.Sprintf("%sfiles/%d/%s", prefix, f.Fileid, pathescape(safeFilename(f.Filename)))
+	})
+}
+
+// Writes user's blog to zip:
+//
+//	about.md                     blog title and about page
+//	entries/<entryid>-<slug>.md  entries with front matter, including drafts
+//	files/<fileid>/<filename>    uploaded files
+//
+// Links to the user's files are rewritten to their relative path in the zip.
+func writeUserExport(db *sql.DB, zw *zip.Writer, u *User) error {
+	s := "SELECT file_id FROM file WHERE user_id = ? ORDER BY file_id"
+	fileids, err := queryIds(db, s, u.Userid)
+	if err != nil {
+		return err
+	}
+	exported := map[int64]bool{}
+	for _, fileid := range fileids {
+		exported[fileid] = true
+	}
+
+	us := findUserSettingsById(db, u.Userid)
+	about := fmt.Sprintf("---\ntitle: %s\n---\n%s", jsonstr(us.BlogTitle), findUserAboutById(db, u.Userid))
+	about = relinkExportFiles(db, about, "", exported)
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     "about.md",
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(fw, about)
+	if err != nil {
+		return err
+	}
+
+	s = "SELECT entry_id FROM entry WHERE user_id = ? ORDER BY entry_id"
+	entryids, err := queryIds(db, s, u.Userid)
+	if err != nil {
+		return err
+	}
+	for _, entryid := range entryids {
+		e := findEntry(db, entryid)
+		if e == nil {
+			continue
+		}
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     entryArchiveName(e),
+			Method:   zip.Deflate,
+			Modified: parseisodate(e.Createdt),
+		})
+		if err != nil {
+			return err
+		}
+		e.Body = relinkExportFiles(db, e.Body, "../", exported)
+		_, err = io.WriteString(fw, entryMarkdown(e))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, fileid := range fileids {
+		f := findFile(db, fileid)
+		if f == nil {
+			continue
+		}
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     fmt.Sprintf("files/%d/%s", f.Fileid, safeFilename(f.Filename)),
+			Method:   zip.Deflate,
+			Modified: parseisodate(f.Createdt),
+		})
+		if err != nil {
+			return err
+		}
+		rc, err := openFileContents(db, f)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//*** Static export ***
+
+// Context key set on requests rendered by exportStatic.
+type staticExportKey struct{}
+
+func isStaticExport(r *http.Request) bool {
+	return r.Context().Value(staticExportKey{}) != nil
+}
+
+// Collects response of a page rendered by exportStatic.
+type staticExportRecorder struct {
+	header      http.Header
+	code        int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *staticExportRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *staticExportRecorder) WriteHeader(code int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.code = code
+	rec.wroteHeader = true
+}
+
+func (rec *staticExportRecorder) Write(bs []byte) (int, error) {
+	rec.wroteHeader = true
+	return rec.body.Write(bs)
+}
+
+var linkAttrRe = regexp.MustCompile(`\s(href|src|srcset)="([^"]*)"`)
+
+// Renders the public pages of the site and all uploaded files to outdir as
+// plain html with relative links, so it can be served by any static host.
+// Pages are rendered by rootHandler as seen by an anonymous visitor,
+// starting from the site and user blog pages and following their links.
+// Links to pages that need the server (search, login, feeds) are left as is.
+// Returns number of pages and files written.
+func exportStatic(db *sql.DB, staticDir, outdir string) (int, int, error) {
+	handler := rootHandler(db)
+	seen := map[string]bool{}
+	queue := []string{"/", "/?page=about", "/?page=tags"}
+
+	uu, err := findUsers(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, u := range uu {
+		base := "/" + pathescape(u.Username)
+		queue = append(queue, base, base+"?page=about", base+"?page=tags")
+	}
+	ff, err := findFiles(db, 0, "", 0, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, f := range ff {
+		queue = append(queue, fmt.Sprintf("/?page=file&id=%d", f.Fileid))
+	}
+
+	npages, nfiles := 0, 0
+	for len(queue) > 0 {
+		surl := queue[0]
+		queue = queue[1:]
+		outpath := staticExportPath(db, surl)
+		if outpath == "" || seen[outpath] {
+			continue
+		}
+		seen[outpath] = true
+
+		var bs []byte
+		if strings.HasPrefix(surl, "/static/") {
+			bs, err = ioutil.ReadFile(filepath.Join(staticDir, filepath.FromSlash(strings.TrimPrefix(outpath, "static/"))))
+			if err != nil {
+				logf(LogWarn, "exportStatic: skipping %s (%s)\n", surl, err)
+				continue
+			}
+		} else {
+			r, err := http.NewRequest("GET", surl, nil)
+			if err != nil {
+				logf(LogWarn, "exportStatic: skipping %s (%s)\n", surl, err)
+				continue
+			}
+			r = r.WithContext(context.WithValue(r.Context(), staticExportKey{}, true))
+			rec := &staticExportRecorder{header: http.Header{}, code: http.StatusOK}
+			handler(rec, r)
+			if rec.code != http.StatusOK {
+				logf(LogWarn, "exportStatic: skipping %s (%d)\n", surl, rec.code)
+				continue
+			}
+			bs = rec.body.Bytes()
+		}
+
+		if strings.HasSuffix(outpath, ".html") {
+			var links []string
+			bs = []byte(relinkStaticPage(db, string(bs), outpath, &links))
+			queue = append(queue, links...)
+			npages++
+		} else {
+			nfiles++
+		}
+
+		file := filepath.Join(outdir, filepath.FromSlash(outpath))
+		err = os.MkdirAll(filepath.Dir(file), 0755)
+		if err != nil {
+			return npages, nfiles, err
+		}
+		err = ioutil.WriteFile(file, bs, 0644)
+		if err != nil {
+			return npages, nfiles, err
+		}
+	}
+	return npages, nfiles, nil
+}
+
+// Returns tag's path segment in the static export. Tags with the same slug,
+// ex. "C", "C++" and "C#", are told apart by a hash of the tag.
+func staticTagSegment(tag string) string {
+	slug := slugify(tag)
+	if slug == tag {
+		return slug
+	}
+	sum := sha256.Sum256([]byte(tag))
+	return slug + "-" + hex.EncodeToString(sum[:4])
+}
+
+// Returns the path relative to the export directory that site url surl is
+// written to, or "" if surl isn't exported.
+// Ex.
+//
+//	"/" is "index.html"
+//	"/user123?tag=go&p=2" is "user123/tag/go/page/2/index.html"
+//	"/user123/2026/10/my-post" is "user123/2026/10/my-post/index.html"
+//	"/?page=file&id=12&w=320" is "files/12/320/photo.jpg"
+func staticExportPath(db *sql.DB, surl string) string {
+	u, err := url.Parse(surl)
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return ""
+	}
+	if strings.HasPrefix(u.Path, "/static/") {
+		return strings.TrimPrefix(path.Clean(u.Path), "/")
+	}
+
+	ss := []string{}
+	for _, s := range strings.Split(strings.Trim(u.EscapedPath(), "/"), "/") {
+		s = pathunescape(s)
+		if s == "" || s == "." || s == ".." || strings.ContainsAny(s, "/\\") {
+			continue
+		}
+		ss = append(ss, s)
+	}
+	if len(ss) == 4 || (len(ss) == 2 && ss[0] == "post") {
+		return strings.Join(append(ss, "index.html"), "/")
+	}
+	if len(ss) > 1 {
+		return ""
+	}
+
+	q := u.Query()
+	switch q.Get("page") {
+	case "", "index":
+		if qtag := q.Get("tag"); qtag != "" {
+			ss = append(ss, "tag", staticTagSegment(qtag))
+		}
+		if p := atoi(q.Get("p")); p > 1 {
+			ss = append(ss, "page", strconv.Itoa(p))
+		}
+	case "about", "tags":
+		ss = append(ss, q.Get("page"))
+	case "entry":
+		ss = []string{"entry", strconv.FormatInt(idtoi(q.Get("id")), 10)}
+	case "file":
+		var f *File
+		if qid := idtoi(q.Get("id")); qid > 0 {
+			f = findFile(db, qid)
+		} else if q.Get("filename") != "" {
+			f = findFileByFilename(db, q.Get("filename"))
+		}
+		if f == nil {
+			return ""
+		}
+		ss = []string{"files", strconv.FormatInt(f.Fileid, 10)}
+		if qw := atoi(q.Get("w")); qw > 0 {
+			ss = append(ss, strconv.Itoa(qw))
+		}
+		return strings.Join(append(ss, safeFilename(f.Filename)), "/")
+	default:
+		return ""
+	}
+	return strings.Join(append(ss, "index.html"), "/")
+}
+
+// Rewrites links in page written to pagepath into paths relative to it.
+// Site urls linked to are added to links.
+func relinkStaticPage(db *sql.DB, page, pagepath string, links *[]string) string {
+	relink := func(href string) string {
+		surl := unescape(href)
+		frag := ""
+		if i := strings.Index(surl, "#"); i >= 0 {
+			surl, frag = surl[:i], surl[i:]
+		}
+		if surl == "" {
+			return href
+		}
+		target := staticExportPath(db, surl)
+		if target == "" {
+			return href
+		}
+		*links = append(*links, surl)
+
+		rel, err := filepath.Rel(path.Dir(pagepath), target)
+		if err != nil {
+			return href
+		}
+		ss := strings.Split(filepath.ToSlash(rel), "/")
+		for i := range ss {
+			ss[i] = pathescape(ss[i])
+		}
+		return escape(strings.Join(ss, "/") + frag)
+	}
+
+	return linkAttrRe.ReplaceAllStringFunc(page, func(attr string) string {
+		m := linkAttrRe.FindStringSubmatch(attr)
+		if m[1] != "srcset" {
+			return fmt.Sprintf(` %s="%s"`, m[1], relink(m[2]))
+		}
+		// srcset="url1 320w, url2 640w"
+		cc := strings.Split(m[2], ",")
+		for i, c := range cc {
+			c = strings.TrimSpace(c)
+			if j := strings.IndexAny(c, " \t"); j >= 0 {
+				cc[i] = relink(c[:j]) + c[j:]
+			} else {
+				cc[i] = relink(c)
+			}
+		}
+		return fmt.Sprintf(` srcset="%s"`, strings.Join(cc, ", "))
+	})
+}
+
+//*** Backup and restore ***
+
+// Backup archive (.tar.gz) contents:
+//
+//	backup.json                  format version, schema version, date
+//	site.json                    Site
+//	users.json                   []User, with password hashes
+//	usersettings.json            []UserSettings
+//	files.json                   []File
+//	files/<fileid>/<filename>    file contents
+//	entries/<entryid>-<slug>.md  entry markdown with front matter
+//	comments.json                []Comment
+//	revisions.json               []EntryRevision
+//	slugs.json                   []EntrySlug, old slugs of renamed entries
+//
+// Sessions and api tokens are not backed up.
+const backupFormat = 1
+
+type BackupInfo struct {
+	Format        int    `json:"format"`
+	SchemaVersion int    `json:"schemaversion"`
+	Createdt      string `json:"createdt"`
+}
+
+// Old slug of a renamed entry, redirected to its current url.
+type EntrySlug struct {
+	Slug    string `json:"slug"`
+	Entryid int64  `json:"entryid"`
+}
+
+// Writes site in db to a backup archive. The db is first copied with
+// VACUUM INTO, so the backup is consistent while the server keeps running.
+func backupSite(db *sql.DB, outfile string) error {
+	tmpdir, err := ioutil.TempDir("", "freeblog-backup")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	snapfile := filepath.Join(tmpdir, "snapshot.db")
+	_, err = sqlexec(db, "VACUUM INTO ?", snapfile)
+	if err != nil {
+		return fmt.Errorf("Error copying db (%s)", err)
+	}
+	snapdb, err := openDB(snapfile)
+	if err != nil {
+		return err
+	}
+	defer snapdb.Close()
+	_, err = migrateDB(snapdb, io.Discard, false)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file first so an interrupted backup doesn't look complete.
+	tmpfile := outfile + ".tmp"
+	out, err := os.Create(tmpfile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile)
+	gzw := gzip.NewWriter(out)
+	tw := tar.NewWriter(gzw)
+	err = writeBackup(snapdb, tw)
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gzw.Close()
+	}
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, outfile)
+}
+
+func writeBackup(db *sql.DB, tw *tar.Writer) error {
+	now := time.Now()
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	writeJson := func(name string, v interface{}) error {
+		return writeTarFile(tw, name, now, []byte(jsonstr(v)))
+	}
+
+	err = writeJson("backup.json", BackupInfo{backupFormat, version, isodate(now)})
+	if err != nil {
+		return err
+	}
+	site := findSite(db)
+	site.About = findSiteAbout(db)
+	err = writeJson("site.json", site)
+	if err != nil {
+		return err
+	}
+
+	userids, err := queryIds(db, "SELECT user_id FROM user ORDER BY user_id")
+	if err != nil {
+		return err
+	}
+	uu := []*User{}
+	for _, userid := range userids {
+		uu = append(uu, findUserById(db, userid))
+	}
+	err = writeJson("users.json", uu)
+	if err != nil {
+		return err
+	}
+
+	userids, err = queryIds(db, "SELECT user_id FROM usersettings ORDER BY user_id")
+	if err != nil {
+		return err
+	}
+	uss := []*UserSettings{}
+	for _, userid := range userids {
+		us := findUserSettingsById(db, userid)
+		us.BlogAbout = findUserAboutById(db, userid)
+		uss = append(uss, us)
+	}
+	err = writeJson("usersettings.json", uss)
+	if err != nil {
+		return err
+	}
+
+	fileids, err := queryIds(db, "SELECT file_id FROM file ORDER BY file_id")
+	if err != nil {
+		return err
+	}
+	ff := []*File{}
+	for _, fileid := range fileids {
+		ff = append(ff, findFile(db, fileid))
+	}
+	err = writeJson("files.json", ff)
+	if err != nil {
+		return err
+	}
+	for _, f := range ff {
+		err := writeBackupFile(db, tw, f)
+		if err != nil {
+			return err
+		}
+	}
+
+	entryids, err := queryIds(db, "SELECT entry_id FROM entry ORDER BY entry_id")
+	if err != nil {
+		return err
+	}
+	cc := []*Comment{}
+	rr := []*EntryRevision{}
+	for _, entryid := range entryids {
+		e := findEntry(db, entryid)
+		err := writeTarFile(tw, entryArchiveName(e), parseisodate(e.Createdt), []byte(entryMarkdown(e)))
+		if err != nil {
+			return err
+		}
+		ecc, err := findComments(db, entryid, "")
+		if err != nil {
+			return err
+		}
+		cc = append(cc, ecc...)
+		err = queryEntryRevisions(db, &rr, entryid)
+		if err != nil {
+			return err
+		}
+	}
+	err = writeJson("comments.json", cc)
+	if err != nil {
+		return err
+	}
+	err = writeJson("revisions.json", rr)
+	if err != nil {
+		return err
+	}
+
+	slugs, err := findEntrySlugs(db)
+	if err != nil {
+		return err
+	}
+	return writeJson("slugs.json", slugs)
+}
+
+// Appends revisions of entry to rr, oldest first. Revision authors are
+// kept as user ids, even if the user was deleted.
+func queryEntryRevisions(db *sql.DB, rr *[]*EntryRevision, entryid int64) error {
+	s := "SELECT entry_id, rev, title, body, tags, createdt, user_id FROM entry_revision WHERE entry_id = ? ORDER BY rev"
+	rows, err := db.Query(s, entryid)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var er EntryRevision
+		rows.Scan(&er.Entryid, &er.Rev, &er.Title, &er.Body, &er.Tags, &er.Createdt, &er.Userid)
+		*rr = append(*rr, &er)
+	}
+	return rows.Err()
+}
+
+// Returns old slugs of all renamed entries.
+func findEntrySlugs(db *sql.DB) ([]*EntrySlug, error) {
+	rows, err := db.Query("SELECT slug, entry_id FROM entry_slug ORDER BY entry_id, slug")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	slugs := []*EntrySlug{}
+	for rows.Next() {
+		var es EntrySlug
+		rows.Scan(&es.Slug, &es.Entryid)
+		slugs = append(slugs, &es)
+	}
+	return slugs, rows.Err()
+}
+
+func writeBackupFile(db *sql.DB, tw *tar.Writer, f *File) error {
+	rc, err := openFileContents(db, f)
+	if err != nil {
+		return fmt.Errorf("Error reading file %d '%s' (%s)", f.Fileid, f.Filename, err)
+	}
+	defer rc.Close()
+	size, err := rc.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	_, err = rc.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    fmt.Sprintf("files/%d/%s", f.Fileid, safeFilename(f.Filename)),
+		Mode:    0644,
+		Size:    size,
+		ModTime: parseisodate(f.Createdt),
+	}
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, rc)
+	return err
+}
+
+func writeTarFile(tw *tar.Writer, name string, modtime time.Time, bs []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(bs)),
+		ModTime: modtime,
+	}
+	err := tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(bs)
+	return err
+}
+
+// Returns ids selected by query s.
+func queryIds(db *sql.DB, s string, qq ...interface{}) ([]int64, error) {
+	rows, err := db.Query(s, qq...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Ex. "entries/12-my-post.md"
+func entryArchiveName(e *Entry) string {
+	if e.Slug == "" {
+		return fmt.Sprintf("entries/%d.md", e.Entryid)
 	}
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "Use POST method", 401)
-			return
-		}
+	return fmt.Sprintf("entries/%d-%s.md", e.Entryid, e.Slug)
+}
 
-		u := validateApiUser(db, r)
-		if u == nil {
-			http.Error(w, "Invalid user", 401)
-			return
-		}
-		bs, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			handleErr(w, err, "POST apichangepwdHandler")
-			return
-		}
-		var req Req
-		err = json.Unmarshal(bs, &req)
-		if err != nil {
-			handleErr(w, err, "POST apichangepwdHandler")
-			return
-		}
-		if u.Userid != 1 && req.Userid != u.Userid {
-			http.Error(w, "Not authorized", 401)
-			return
-		}
-		err = edituser(db, req.Userid, req.Pwd, req.Newpwd)
-		if err == ErrLoginIncorrect {
-			http.Error(w, err.Error(), 401)
-			return
-		}
-		if err != nil {
-			handleErr(w, err, "POST apichangepwdHandler")
-			return
-		}
+// Returns filename usable as a single path element.
+func safeFilename(filename string) string {
+	filename = path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if filename == "." || filename == "/" || filename == ".." {
+		filename = "file"
 	}
+	return filename
 }
 
-func apideluserHandler(db *sql.DB) http.HandlerFunc {
-	type Req struct {
-		Userid int64  `json:"userid"`
-		Pwd    string `json:"pwd"`
-	}
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "Use POST method", 401)
-			return
+// Returns entry as markdown with yaml front matter.
+// Values are written as json strings, which are valid yaml.
+func entryMarkdown(e *Entry) string {
+	tags := []string{}
+	for _, t := range strings.Split(e.Tags, ",") {
+		t = strings.TrimSpace(t)
+		if t != "" {
+			tags = append(tags, t)
 		}
+	}
+	jstr := func(v interface{}) string {
+		bs, _ := json.Marshal(v)
+		return string(bs)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("---\n")
+	fmt.Fprintf(&sb, "title: %s\n", jstr(e.Title))
+	fmt.Fprintf(&sb, "slug: %s\n", jstr(e.Slug))
+	fmt.Fprintf(&sb, "author: %s\n", jstr(e.Username))
+	fmt.Fprintf(&sb, "createdt: %s\n", jstr(e.Createdt))
+	fmt.Fprintf(&sb, "status: %s\n", jstr(e.Status))
+	if e.Publishat != "" {
+		fmt.Fprintf(&sb, "publishat: %s\n", jstr(e.Publishat))
+	}
+	fmt.Fprintf(&sb, "tags: %s\n", jstr(tags))
+	sb.WriteString("---\n")
+	sb.WriteString(e.Body)
+	return sb.String()
+}
+
+// Splits markdown into front matter fields and body. Handles the simple
+// front matter written by blog engines: yaml between "---" lines or toml
+// between "+++" lines, with top level "key: value" (or "key = value")
+// scalars, quoted or not, and lists as [a, b] or "- a" lines. List values
+// are returned joined with ", ".
+func parseFrontMatter(s string) (map[string]string, string) {
+	fields := map[string]string{}
+	s = strings.TrimPrefix(s, "\ufeff")
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	delim, sep := "---", ":"
+	if strings.HasPrefix(s, "+++\n") {
+		delim, sep = "+++", "="
+	}
+	if !strings.HasPrefix(s, delim+"\n") {
+		return fields, s
+	}
+	rest := "\n" + s[4:]
+	end := strings.Index(rest, "\n"+delim)
+	if end == -1 {
+		return fields, s
+	}
+	lines := strings.Split(rest[:end], "\n")
+	body := rest[end+4:]
+	if i := strings.Index(body, "\n"); i >= 0 {
+		body = body[i+1:]
+	} else {
+		body = ""
+	}
 
-		u := validateApiUser(db, r)
-		if u == nil {
-			http.Error(w, "Invalid user", 401)
-			return
-		}
-		bs, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			handleErr(w, err, "POST apideluserHandler")
-			return
-		}
-		var req Req
-		err = json.Unmarshal(bs, &req)
-		if err != nil {
-			handleErr(w, err, "POST apideluserHandler")
-			return
+	unquote := func(v string) string {
+		v = strings.TrimSpace(v)
+		if strings.HasPrefix(v, "\"") {
+			var us string
+			if json.Unmarshal([]byte(v), &us) == nil {
+				return us
+			}
 		}
-		if u.Userid != 1 && req.Userid != u.Userid {
-			http.Error(w, "Not authorized", 401)
-			return
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			return v[1 : len(v)-1]
 		}
+		return v
+	}
 
-		err = deluser(db, req.Userid, req.Pwd)
-		if err == ErrLoginIncorrect {
-			http.Error(w, err.Error(), 401)
-			return
+	lastkey := ""
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
 		}
-		if err != nil {
-			handleErr(w, err, "POST apideluserHandler")
-			return
+		if sep == "=" && strings.HasPrefix(trimmed, "[") {
+			// toml [table], only top level keys are read
+			break
 		}
-		// Admin takes ownership of deleted user's entries and files.
-		err = transferUserEntries(db, req.Userid, 1)
-		if err != nil {
-			handleErr(w, err, "POST apideluserHandler")
-			return
+		if strings.HasPrefix(trimmed, "- ") && lastkey != "" {
+			// block list item under lastkey
+			v := unquote(trimmed[2:])
+			if fields[lastkey] != "" {
+				v = fields[lastkey] + ", " + v
+			}
+			fields[lastkey] = v
+			continue
 		}
-		err = transferUserFiles(db, req.Userid, 1)
-		if err != nil {
-			handleErr(w, err, "POST apideluserHandler")
-			return
+		i := strings.Index(line, sep)
+		if i == -1 || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		v := strings.TrimSpace(line[i+1:])
+		lastkey = key
+		if strings.HasPrefix(v, "[") && strings.HasSuffix(v, "]") {
+			items := []string{}
+			for _, item := range strings.Split(v[1:len(v)-1], ",") {
+				item = unquote(item)
+				if item != "" {
+					items = append(items, item)
+				}
+			}
+			fields[key] = strings.Join(items, ", ")
+			continue
 		}
+		fields[key] = unquote(v)
 	}
+	return fields, body
 }
 
-func apiloginHandler(db *sql.DB) http.HandlerFunc {
-	type Req struct {
-		Userid int64  `json:"userid"`
-		Pwd    string `json:"pwd"`
+// Restores backup archive created by backupSite into db, which should be
+// newly created. File contents are added to the blob store.
+func restoreSite(db *sql.DB, infile string) error {
+	in, err := os.Open(infile)
+	if err != nil {
+		return err
 	}
-	type Resp struct {
-		Userid int64  `json:"userid"`
-		Sig    string `json:"sig"`
+	defer in.Close()
+	gzr, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("'%s' is not a backup archive (%s)", infile, err)
 	}
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "Use POST method", 401)
-			return
-		}
+	tr := tar.NewReader(gzr)
 
-		bs, err := ioutil.ReadAll(r.Body)
+	files := map[int64]*File{}
+	entries := []*Entry{}
+	comments := []*Comment{}
+	revisions := []*EntryRevision{}
+	slugs := []*EntrySlug{}
+	readJson := func(name string, v interface{}) error {
+		bs, err := ioutil.ReadAll(tr)
 		if err != nil {
-			handleErr(w, err, "POST apiloginHandler")
-			return
+			return err
 		}
-		var req Req
-		err = json.Unmarshal(bs, &req)
+		err = json.Unmarshal(bs, v)
 		if err != nil {
-			handleErr(w, err, "POST apiloginHandler")
-			return
+			return fmt.Errorf("Error reading %s (%s)", name, err)
 		}
+		return nil
+	}
 
-		u, sig, err := loginUserid(db, req.Userid, req.Pwd)
-		if err == ErrLoginIncorrect {
-			http.Error(w, err.Error(), 401)
-			return
+	nfiles := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
 		}
 		if err != nil {
-			handleErr(w, err, "POST apiloginHandler")
-			return
+			return err
 		}
-		setLoginCookie(w, u, sig)
-
-		var resp Resp
-		resp.Userid = u.Userid
-		resp.Sig = sig
-
-		w.Header().Set("Content-Type", "application/json")
-		P := makeFprintf(w)
-		P("%s", jsonstr(resp))
-	}
-}
-
-func apilogoutHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "Use POST", 401)
-			return
+		if hdr.Typeflag != tar.TypeReg {
+			continue
 		}
 
-		delLoginCookie(w)
-	}
-}
-
-// GET /api/entry?id=123
-// DELETE /api/entry?id=123
-// POST /api/entry {...}
-// PUT /api/entry {...}
-func apientryHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "GET" {
-			qid := idtoi(r.FormValue("id"))
-			qfmt := r.FormValue("fmt")
-			if qid == 0 {
-				http.Error(w, "Not found.", 404)
-				return
-			}
-
-			e := findEntry(db, qid)
-			if e == nil {
-				http.Error(w, "Not found.", 404)
-				return
-			}
-
-			w.Header().Set("Content-Type", "application/json")
-			P := makeFprintf(w)
-			if qfmt == "html" {
-				printViewEntry(P, db, e)
-				return
-			}
-			P("%s", jsonstr(e))
-			return
-		} else if r.Method == "POST" {
-			u := validateApiUser(db, r)
-			if u == nil {
-				http.Error(w, "Invalid user", 401)
-				return
-			}
-			bs, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				handleErr(w, err, "POST apientryHandler")
-				return
-			}
-			var e Entry
-			err = json.Unmarshal(bs, &e)
-			if err != nil {
-				handleErr(w, err, "POST apientryHandler")
-				return
-			}
-			e.Userid = u.Userid
-			e.Createdt = isodate(time.Now())
-			newid, err := createEntry(db, &e)
-			if err != nil {
-				handleErr(w, err, "POST apientryHandler")
-				return
+		switch {
+		case hdr.Name == "backup.json":
+			var info BackupInfo
+			err = readJson(hdr.Name, &info)
+			if err == nil && info.Format > backupFormat {
+				err = fmt.Errorf("Backup format %d is newer than this version of freeblog supports", info.Format)
 			}
-			e.Entryid = newid
-
-			w.Header().Set("Content-Type", "application/json")
-			P := makeFprintf(w)
-			P("%s", jsonstr(e))
-			return
-		} else if r.Method == "PUT" {
-			u := validateApiUser(db, r)
-			if u == nil {
-				http.Error(w, "Invalid user", 401)
-				return
+		case hdr.Name == "site.json":
+			var site Site
+			err = readJson(hdr.Name, &site)
+			if err == nil {
+				err = createSite(db, &site)
 			}
-			bs, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				handleErr(w, err, "PUT apientryHandler")
-				return
+		case hdr.Name == "users.json":
+			var uu []*User
+			err = readJson(hdr.Name, &uu)
+			for _, u := range uu {
+				if err != nil {
+					break
+				}
+				s := "INSERT OR REPLACE INTO user (user_id, username, password, role, quota) VALUES (?, ?, ?, ?, ?)"
+				_, err = sqlexec(db, s, u.Userid, u.Username, u.HashedPwd, u.Role, u.Quota)
 			}
-			var e Entry
-			err = json.Unmarshal(bs, &e)
-			if err != nil {
-				handleErr(w, err, "PUT apientryHandler")
-				return
+		case hdr.Name == "usersettings.json":
+			var uss []*UserSettings
+			err = readJson(hdr.Name, &uss)
+			for _, us := range uss {
+				if err != nil {
+					break
+				}
+				err = createUserSettings(db, us)
 			}
-			if u.Userid != 1 && e.Userid != u.Userid {
-				http.Error(w, "Not authorized", 401)
-				return
+		case hdr.Name == "files.json":
+			var ff []*File
+			err = readJson(hdr.Name, &ff)
+			for _, f := range ff {
+				files[f.Fileid] = f
 			}
-			err = editEntry(db, &e)
-			if err != nil {
-				handleErr(w, err, "PUT apientryHandler")
-				return
+		case hdr.Name == "comments.json":
+			err = readJson(hdr.Name, &comments)
+		case hdr.Name == "revisions.json":
+			err = readJson(hdr.Name, &revisions)
+		case hdr.Name == "slugs.json":
+			err = readJson(hdr.Name, &slugs)
+		case strings.HasPrefix(hdr.Name, "files/"):
+			err = restoreBackupFile(db, tr, hdr, files)
+			nfiles++
+		case strings.HasPrefix(hdr.Name, "entries/") && strings.HasSuffix(hdr.Name, ".md"):
+			var bs []byte
+			bs, err = ioutil.ReadAll(tr)
+			if err == nil {
+				entries = append(entries, parseBackupEntry(hdr.Name, string(bs)))
 			}
+		}
+		if err != nil {
+			return fmt.Errorf("Error restoring %s (%s)", hdr.Name, err)
+		}
+	}
 
-			w.Header().Set("Content-Type", "application/json")
-			P := makeFprintf(w)
-			P("%s", jsonstr(e))
-			return
-		} else if r.Method == "DELETE" {
-			u := validateApiUser(db, r)
+	// Entries, comments and revisions are added last, after the users they
+	// refer to.
+	for _, e := range entries {
+		if e.Username != "" {
+			u := findUserByUsername(db, e.Username)
 			if u == nil {
-				http.Error(w, "Invalid user", 401)
-				return
-			}
-			qid := idtoi(r.FormValue("id"))
-			if qid == 0 {
-				http.Error(w, "Not found.", 404)
-				return
+				return fmt.Errorf("Entry '%s' author '%s' not found in users.json", e.Title, e.Username)
 			}
+			e.Userid = u.Userid
+		}
+		err := restoreEntry(db, e)
+		if err != nil {
+			return fmt.Errorf("Error restoring entry '%s' (%s)", e.Title, err)
+		}
+	}
+	for _, c := range comments {
+		s := "INSERT INTO comment (comment_id, entry_id, parent_id, user_id, name, body, createdt, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+		_, err := sqlexec(db, s, c.Commentid, c.Entryid, c.Parentid, c.Userid, c.Name, c.Body, c.Createdt, c.Status)
+		if err != nil {
+			return fmt.Errorf("Error restoring comment %d (%s)", c.Commentid, err)
+		}
+	}
+	err = restoreEntryHistory(db, revisions, slugs)
+	if err != nil {
+		return err
+	}
+	logf(LogInfo, "Restored %d entries, %d files, %d comments, %d revisions\n", len(entries), nfiles, len(comments), len(revisions))
+	return nil
+}
 
-			e := findEntry(db, qid)
-			if e == nil {
-				http.Error(w, "Not found.", 404)
-				return
+// Replaces the first revision added by restoreEntry with the backed up
+// revisions of each entry, and adds old slugs. Backups made before
+// revisions.json was added have none, and keep the first revision.
+func restoreEntryHistory(db *sql.DB, revisions []*EntryRevision, slugs []*EntrySlug) error {
+	return withWriteTx(db, func(tx *sql.Tx) error {
+		cleared := map[int64]bool{}
+		for _, er := range revisions {
+			if !cleared[er.Entryid] {
+				_, err := txexec(tx, "DELETE FROM entry_revision WHERE entry_id = ?", er.Entryid)
+				if err != nil {
+					return err
+				}
+				cleared[er.Entryid] = true
 			}
-			if u.Userid != 1 && e.Userid != u.Userid {
-				http.Error(w, "Not authorized", 401)
-				return
+			s := "INSERT INTO entry_revision (entry_id, rev, title, body, tags, createdt, user_id) VALUES (?, ?, ?, ?, ?, ?, ?)"
+			_, err := txexec(tx, s, er.Entryid, er.Rev, er.Title, er.Body, er.Tags, er.Createdt, er.Userid)
+			if err != nil {
+				return fmt.Errorf("Error restoring entry %d revision %d (%s)", er.Entryid, er.Rev, err)
 			}
-
-			err := delEntry(db, qid)
+		}
+		for _, es := range slugs {
+			s := "INSERT OR REPLACE INTO entry_slug (slug, entry_id) VALUES (?, ?)"
+			_, err := txexec(tx, s, es.Slug, es.Entryid)
 			if err != nil {
-				handleErr(w, err, "DEL apientryHandler")
-				return
+				return fmt.Errorf("Error restoring slug '%s' (%s)", es.Slug, err)
 			}
-			return
 		}
+		return nil
+	})
+}
 
-		http.Error(w, "Use GET/POST/PUT/DELETE", 401)
+// Adds file from files/<fileid>/<filename> in the archive.
+func restoreBackupFile(db *sql.DB, tr *tar.Reader, hdr *tar.Header, files map[int64]*File) error {
+	ss := strings.Split(hdr.Name, "/")
+	if len(ss) != 3 {
+		return fmt.Errorf("Expected files/<fileid>/<filename>")
+	}
+	bs, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return err
+	}
+	fileid := idtoi(ss[1])
+	f := files[fileid]
+	if f == nil {
+		// Not in files.json, give it to an admin.
+		admin := findFirstAdmin(db, 0)
+		if admin == nil {
+			return fmt.Errorf("No admin user in users.json to own file not in files.json")
+		}
+		f = &File{Fileid: fileid, Filename: ss[2], Createdt: isodate(hdr.ModTime), Userid: admin.Userid}
+	}
+	if f.Mimetype == "" {
+		f.Mimetype = detectMimetype(f.Filename, bs)
+	}
+	f.Blobkey = blobKey(bs)
+	f.Size = int64(len(bs))
+	f.Width, f.Height = imageSize(bs)
+	err = blobs.Put(f.Blobkey, bs)
+	if err != nil {
+		return err
 	}
+	s := "INSERT INTO file (file_id, filename, title, blobkey, size, mimetype, width, height, createdt, user_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err = sqlexec(db, s, f.Fileid, f.Filename, f.Title, f.Blobkey, f.Size, f.Mimetype, f.Width, f.Height, f.Createdt, f.Userid)
+	return err
 }
 
-func printViewEntry(P PrintFunc, db *sql.DB, e *Entry) {
-	P("<h1 class=\"text-2xl mb-2\">%s</h1>\n", escape(e.Title))
-	if e.Username != "" {
-		P("<p class=\"mb-4 text-sm\">Posted on \n")
-		P("    <span class=\"italic\">%s</span> by %s\n", formatdate(e.Createdt), e.Username)
-		P("</p>\n")
-	} else {
-		P("<p class=\"mb-4 text-sm\">Posted on <span class=\"italic\">%s</span></p>\n", formatdate(e.Createdt))
+// Parses entries/<entryid>-<slug>.md into an entry.
+func parseBackupEntry(name, md string) *Entry {
+	fields, body := parseFrontMatter(md)
+	var e Entry
+	base := strings.TrimSuffix(path.Base(name), ".md")
+	e.Entryid = idtoi(strings.SplitN(base, "-", 2)[0])
+	e.Title = fields["title"]
+	e.Slug = fields["slug"]
+	e.Username = fields["author"]
+	e.Createdt = fields["createdt"]
+	e.Status = fields["status"]
+	e.Publishat = fields["publishat"]
+	e.Tags = fields["tags"]
+	e.Body = body
+	if e.Createdt == "" {
+		e.Createdt = isodate(time.Now())
+	}
+	if e.Status == "" {
+		e.Status = EntryPublished
 	}
-	P("<div class=\"content\">\n")
-	P("%s\n", parseMarkdown(e.Body))
-	P("</div>\n")
+	return &e
 }
 
-// GET /api/entries
-// GET /api/entries?userid=2
-// GET /api/entries?tag=abc
-// GET /api/entries?limit=10
-// GET /api/entries?limit=10&offset=20
-func apientriesHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var ee []*Entry
-		var err error
-
-		quserid := idtoi(r.FormValue("userid"))
-		qtag := r.FormValue("tag")
-		qlimit := atoi(r.FormValue("limit"))
-		qoffset := atoi(r.FormValue("offset"))
+// Adds entry keeping its id, with tags, search index and a first revision.
+// Status and publishat are validated like entries saved by the api, as the
+// archive may have been edited by hand.
+func restoreEntry(db *sql.DB, e *Entry) error {
+	err := validateEntryStatus(e)
+	if err != nil {
+		return err
+	}
+	if e.Slug == "" {
+		e.Slug = e.Title
+	}
+	return withWriteTx(db, func(tx *sql.Tx) error {
+		e.Slug = makeUniqueSlug(tx, e.Slug, e.Entryid)
 
-		ee, err = findEntries(db, quserid, qtag, qlimit, qoffset)
+		var err error
+		if e.Entryid > 0 {
+			s := "INSERT INTO entry (entry_id, title, body, createdt, user_id, status, publishat, slug) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+			_, err = txexec(tx, s, e.Entryid, e.Title, e.Body, e.Createdt, e.Userid, e.Status, e.Publishat, e.Slug)
+		} else {
+			var result sql.Result
+			s := "INSERT INTO entry (title, body, createdt, user_id, status, publishat, slug) VALUES (?, ?, ?, ?, ?, ?, ?)"
+			result, err = txexec(tx, s, e.Title, e.Body, e.Createdt, e.Userid, e.Status, e.Publishat, e.Slug)
+			if err == nil {
+				e.Entryid, err = result.LastInsertId()
+			}
+		}
 		if err != nil {
-			handleErr(w, err, "apientriesHandler")
+			return err
 		}
-
-		w.Header().Set("Content-Type", "application/json")
-		P := makeFprintf(w)
-		P("%s", jsonstr(ee))
-	}
+		err = setEntryTags(tx, e.Entryid, e.Tags)
+		if err != nil {
+			return err
+		}
+		err = createEntryRevision(tx, e, e.Userid)
+		if err != nil {
+			return err
+		}
+		return indexEntry(tx, e)
+	})
 }
 
-// If another file has the same filename, add a --n to make unique.
-// Ex. "Abc File", "Abc File--1", "Abc File--2", etc.
-func makeUniqueFilename(db *sql.DB, filename string) string {
-	uniqueFilename := filename
-	for i := 1; i < 100; i++ {
-		f := findFileByFilename(db, uniqueFilename)
-		if f == nil {
-			return uniqueFilename
-		}
-		ext := filepath.Ext(filename)
-		base := strings.TrimSuffix(filename, ext)
-		uniqueFilename = fmt.Sprintf("%s--%d%s", base, i, ext)
-	}
+//*** Import ***
 
-	// If code reached this point, that means we're at (100) which is very unusual.
-	// Rather than risk an overly long loop, let's just cap it off at (100).
-	return uniqueFilename
+// Entry read from another blog engine, before it is added.
+type ImportEntry struct {
+	Title     string
+	Body      string
+	Createdt  string
+	Tags      []string
+	Status    string
+	Publishat string
+	Slug      string
+	Author    string
+
+	// Directory of markdown file, to find images linked by relative path.
+	Dir string
 }
 
-func baseFilename(filename string) string {
-	ext := filepath.Ext(filename)
-	base := strings.TrimSuffix(filename, ext)
-	return base
+type ImportResult struct {
+	Entries  int      `json:"entries"`
+	Files    int      `json:"files"`
+	Warnings []string `json:"warnings"`
 }
 
-func apiuploadfilesHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "Use POST method", 401)
-			return
-		}
+// Imports from WordPress export xml file, or directory or zip file of markdown files.
+func importSource(db *sql.DB, src string, defaultu *User) (*ImportResult, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return importMarkdown(db, os.DirFS(src), defaultu)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return importFile(db, f, fi.Size(), src, defaultu)
+}
 
-		u := validateApiUser(db, r)
-		if u == nil {
-			http.Error(w, "Invalid user", 401)
-			return
+// Reads WordPress WXR export xml or a zip file of markdown files from src,
+// going by filename extension. See importWxr and importMarkdown.
+func importFile(db *sql.DB, src io.ReaderAt, size int64, filename string, defaultu *User) (*ImportResult, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == ".xml" {
+		return importWxr(db, io.NewSectionReader(src, 0, size), defaultu)
+	}
+	if ext == ".zip" {
+		zr, err := zip.NewReader(src, size)
+		if err != nil {
+			return nil, err
 		}
+		return importMarkdown(db, zr, defaultu)
+	}
+	return nil, fmt.Errorf("Import a WordPress export (.xml) or a zip of markdown files (.zip)")
+}
+
+// Imports posts from WordPress export (WXR) xml. Images hosted on the
+// WordPress site are downloaded into files.
+func importWxr(db *sql.DB, r io.Reader, defaultu *User) (*ImportResult, error) {
+	type wxrCategory struct {
+		Domain string `xml:"domain,attr"`
+		Name   string `xml:",chardata"`
+	}
+	type wxrItem struct {
+		Title       string        `xml:"title"`
+		PubDate     string        `xml:"pubDate"`
+		Creator     string        `xml:"http://purl.org/dc/elements/1.1/ creator"`
+		Content     string        `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+		PostDate    string        `xml:"post_date"`
+		PostDateGmt string        `xml:"post_date_gmt"`
+		PostName    string        `xml:"post_name"`
+		Status      string        `xml:"status"`
+		PostType    string        `xml:"post_type"`
+		Categories  []wxrCategory `xml:"category"`
+	}
+	var rss struct {
+		Channel struct {
+			Link        string    `xml:"link"`
+			BaseSiteUrl string    `xml:"base_site_url"`
+			BaseBlogUrl string    `xml:"base_blog_url"`
+			Items       []wxrItem `xml:"item"`
+		} `xml:"channel"`
+	}
+	err := xml.NewDecoder(r).Decode(&rss)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading WordPress export (%s)", err)
+	}
 
-		r.ParseMultipartForm(32 << 20)
-		hh := r.MultipartForm.File["files"]
-		for _, h := range hh {
-			f, err := h.Open()
-			if err != nil {
-				handleErr(w, err, "apiuploadfilesHandler")
-				return
-			}
-			defer f.Close()
+	im := newImporter(db, defaultu, nil)
+	for _, surl := range []string{rss.Channel.Link, rss.Channel.BaseSiteUrl, rss.Channel.BaseBlogUrl} {
+		u, err := url.Parse(strings.TrimSpace(surl))
+		if err == nil && u.Host != "" {
+			im.hosts = append(im.hosts, strings.ToLower(u.Host))
+		}
+	}
 
-			var file File
-			bs, err := ioutil.ReadAll(f)
-			if err != nil {
-				handleErr(w, err, "apiuploadfilesHandler")
-				return
+	var ee []*ImportEntry
+	for _, item := range rss.Channel.Items {
+		if item.PostType != "" && item.PostType != "post" {
+			continue
+		}
+		var e ImportEntry
+		e.Title = strings.TrimSpace(item.Title)
+		e.Body = item.Content
+		e.Slug = item.PostName
+		e.Author = item.Creator
+		for _, sdate := range []string{item.PostDateGmt, item.PostDate, item.PubDate} {
+			if t, ok := parseImportDate(sdate); ok {
+				e.Createdt = isodate(t)
+				break
 			}
-			file.Filename = h.Filename
-			file.Title = baseFilename(h.Filename)
-			file.Bytes = bs
-			file.Createdt = isodate(time.Now())
-			file.Userid = u.Userid
-			_, err = createFile(db, &file)
-			if err != nil {
-				handleErr(w, err, "apiuploadfilesHandler")
-				return
+		}
+		for _, c := range item.Categories {
+			tag := strings.TrimSpace(c.Name)
+			if (c.Domain == "post_tag" || c.Domain == "category") && tag != "" && !strings.EqualFold(tag, "uncategorized") {
+				e.Tags = append(e.Tags, tag)
 			}
 		}
+		switch item.Status {
+		case "publish", "":
+			e.Status = EntryPublished
+		case "future":
+			e.Status = EntryScheduled
+		default:
+			// draft, pending, private
+			e.Status = EntryDraft
+		}
+		ee = append(ee, &e)
 	}
+	im.addEntries(ee)
+	return im.res, nil
 }
 
-// GET /api/file?id=123
-// DELETE /api/file?id=123
-// POST /api/file {...}
-// PUT /api/file {...}
-func apifileHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "GET" {
-			qid := idtoi(r.FormValue("id"))
-			if qid == 0 {
-				http.Error(w, "Specify file id (id=nnn)", 401)
-				return
-			}
-			f := findFile(db, qid)
-			if f == nil {
-				http.Error(w, "Not found.", 404)
-				return
-			}
-			f.Url = fileurl(f)
-
-			w.Header().Set("Content-Type", "application/json")
-			P := makeFprintf(w)
-			P("%s", jsonstr(f))
-			return
-		} else if r.Method == "POST" {
-			u := validateApiUser(db, r)
-			if u == nil {
-				http.Error(w, "Invalid user", 401)
-				return
-			}
-			bs, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				handleErr(w, err, "POST apientryHandler")
-				return
-			}
-			var f File
-			err = json.Unmarshal(bs, &f)
-			if err != nil {
-				handleErr(w, err, "POST apifileHandler")
-				return
-			}
-			f.Userid = u.Userid
-			f.Createdt = isodate(time.Now())
-			newid, err := createFile(db, &f)
-			if err != nil {
-				handleErr(w, err, "POST apifileHandler")
-				return
-			}
-			f.Fileid = newid
+var jekyllFilenameRe = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})-(.+)$`)
 
-			w.Header().Set("Content-Type", "application/json")
-			P := makeFprintf(w)
-			P("%s", jsonstr(f))
-			return
-		} else if r.Method == "PUT" {
-			u := validateApiUser(db, r)
-			if u == nil {
-				http.Error(w, "Invalid user", 401)
-				return
-			}
-			bs, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				handleErr(w, err, "PUT apifileHandler 2")
-				return
-			}
-			var f File
-			err = json.Unmarshal(bs, &f)
-			if err != nil {
-				handleErr(w, err, "PUT apifileHandler 3")
-				return
-			}
-			if u.Userid != 1 && f.Userid != u.Userid {
-				http.Error(w, "Not authorized", 401)
-				return
-			}
-			err = editFile(db, &f)
-			if err != nil {
-				handleErr(w, err, "PUT apifileHandler 4")
-				return
-			}
+// Imports Hugo or Jekyll markdown files with front matter found in fsys.
+// Images linked by relative path, or by site path from the root or Hugo's
+// static/ directory, are added as files.
+func importMarkdown(db *sql.DB, fsys fs.FS, defaultu *User) (*ImportResult, error) {
+	im := newImporter(db, defaultu, fsys)
 
-			w.Header().Set("Content-Type", "application/json")
-			P := makeFprintf(w)
-			P("%s", jsonstr(f))
-			return
-		} else if r.Method == "DELETE" {
-			u := validateApiUser(db, r)
-			if u == nil {
-				http.Error(w, "Invalid user", 401)
-				return
-			}
-			qid := idtoi(r.FormValue("id"))
-			if qid == 0 {
-				http.Error(w, "Not found.", 404)
-				return
+	var ee []*ImportEntry
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if p != "." && (strings.HasPrefix(name, ".") || name == "node_modules" || name == "_site" || name == "public") {
+				return fs.SkipDir
 			}
+			return nil
+		}
+		ext := strings.ToLower(path.Ext(name))
+		if (ext != ".md" && ext != ".markdown") || strings.HasPrefix(name, "_index.") {
+			// _index.md are Hugo section pages
+			return nil
+		}
+		bs, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		fields, body := parseFrontMatter(string(bs))
+		if len(fields) == 0 || fields["layout"] == "page" {
+			// Not a post, ex. README.md
+			return nil
+		}
 
-			f := findFile(db, qid)
-			if f == nil {
-				http.Error(w, "Not found.", 404)
-				return
-			}
-			if u.Userid != 1 && f.Userid != u.Userid {
-				http.Error(w, "Not authorized", 401)
-				return
+		var e ImportEntry
+		e.Dir = path.Dir(p)
+		e.Body = body
+		e.Title = fields["title"]
+		e.Slug = fields["slug"]
+		e.Author = fields["author"]
+		base := strings.TrimSuffix(name, path.Ext(name))
+		if m := jekyllFilenameRe.FindStringSubmatch(base); m != nil {
+			// Jekyll _posts/2020-01-31-my-post.md
+			if e.Slug == "" {
+				e.Slug = m[2]
 			}
-
-			err := delFile(db, qid)
-			if err != nil {
-				handleErr(w, err, "DEL apifileHandler")
-				return
+			fields["filedate"] = m[1]
+		} else if e.Slug == "" && base == "index" {
+			// Hugo page bundle posts/my-post/index.md
+			e.Slug = path.Base(e.Dir)
+		} else if e.Slug == "" {
+			e.Slug = base
+		}
+		if e.Title == "" {
+			e.Title = e.Slug
+		}
+		for _, k := range []string{"date", "filedate", "lastmod"} {
+			if t, ok := parseImportDate(fields[k]); ok {
+				e.Createdt = isodate(t)
+				break
 			}
-			return
 		}
+		for _, k := range []string{"tags", "categories", "category"} {
+			for _, tag := range strings.Split(fields[k], ",") {
+				tag = strings.TrimSpace(tag)
+				if tag != "" {
+					e.Tags = append(e.Tags, tag)
+				}
+			}
+		}
+		e.Status = EntryPublished
+		if fields["draft"] == "true" || fields["published"] == "false" || strings.Contains("/"+p, "/_drafts/") {
+			e.Status = EntryDraft
+		}
+		ee = append(ee, &e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	im.addEntries(ee)
+	return im.res, nil
+}
+
+// Parses dates found in WordPress, Hugo and Jekyll posts into UTC.
+func parseImportDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.HasPrefix(s, "0000-00-00") {
+		return time.Time{}, false
+	}
+	layouts := []string{
+		time.RFC3339,
+		"2006-01-02T15:04:05",
+		"2006-01-02 15:04:05 -0700",
+		"2006-01-02 15:04:05 -07:00",
+		"2006-01-02 15:04:05",
+		"2006-01-02 15:04",
+		"2006-01-02",
+		time.RFC1123Z,
+		time.RFC1123,
+	}
+	for _, layout := range layouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
 
-		http.Error(w, "Use GET/POST/PUT/DELETE", 401)
+type importer struct {
+	db       *sql.DB
+	defaultu *User
+	fsys     fs.FS    // markdown files, nil for wxr imports
+	hosts    []string // hosts that remote images are downloaded from
+	fileids  map[string]int64
+	res      *ImportResult
+}
+
+func newImporter(db *sql.DB, defaultu *User, fsys fs.FS) *importer {
+	return &importer{
+		db:       db,
+		defaultu: defaultu,
+		fsys:     fsys,
+		fileids:  map[string]int64{},
+		res:      &ImportResult{Warnings: []string{}},
 	}
 }
 
-func apifilesHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var ff []*File
-		var err error
+func (im *importer) warnf(format string, a ...interface{}) {
+	s := fmt.Sprintf(format, a...)
+	logf(LogWarn, "import: %s\n", s)
+	im.res.Warnings = append(im.res.Warnings, s)
+}
 
-		quserid := idtoi(r.FormValue("userid"))
-		qfilename := r.FormValue("filename")
-		qlimit := atoi(r.FormValue("limit"))
-		qoffset := atoi(r.FormValue("offset"))
-		qfiletype := r.FormValue("filetype")
+// Adds entries in order of date. Authors are matched to users by username,
+// entries of unknown authors go to the default user.
+func (im *importer) addEntries(ee []*ImportEntry) {
+	now := clock.Now().UTC()
+	for _, ie := range ee {
+		if ie.Createdt == "" {
+			ie.Createdt = isodate(now)
+		}
+	}
+	sort.SliceStable(ee, func(i, j int) bool {
+		return ee[i].Createdt < ee[j].Createdt
+	})
 
-		if qfiletype == "image" {
-			ff, err = findImageFiles(db, quserid, qfilename, qlimit, qoffset)
-		} else if qfiletype == "attachment" {
-			ff, err = findAttachmentFiles(db, quserid, qfilename, qlimit, qoffset)
-		} else {
-			ff, err = findFiles(db, quserid, qfilename, qlimit, qoffset)
+	for _, ie := range ee {
+		u := im.defaultu
+		if ie.Author != "" {
+			if au := findUserByUsername(im.db, ie.Author); au != nil {
+				u = au
+			}
 		}
+
+		var e Entry
+		e.Title = ie.Title
+		e.Createdt = ie.Createdt
+		e.Userid = u.Userid
+		e.Slug = ie.Slug
+		e.Status = ie.Status
+		if e.Status == EntryScheduled || (e.Status == EntryPublished && e.Createdt > isodate(now)) {
+			e.Status = EntryScheduled
+			e.Publishat = e.Createdt
+		}
+		e.Tags = strings.Join(uniqueTags(ie.Tags), ", ")
+		e.Body = im.pullImages(ie, u)
+
+		_, err := createEntry(im.db, &e, false)
 		if err != nil {
-			handleErr(w, err, "apifilesHandler")
+			im.warnf("Error adding '%s' (%s)", ie.Title, err)
+			continue
 		}
+		im.res.Entries++
+	}
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		P := makeFprintf(w)
-		P("%s", jsonstr(ff))
+// Returns tags without duplicates, ignoring case.
+func uniqueTags(tags []string) []string {
+	seen := map[string]bool{}
+	tt := []string{}
+	for _, t := range tags {
+		k := strings.ToLower(t)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		tt = append(tt, t)
 	}
+	return tt
 }
 
-// GET /api/site
-// POST /api/site {...}
-func apisiteHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "GET" {
-			site := findSite(db)
-			if site == nil {
-				http.Error(w, "Not found.", 404)
-				return
-			}
-			site.About = findSiteAbout(db)
+var importImgRe = regexp.MustCompile(`(?i)<img\s[^>]*>`)
+var importImgSrcRe = regexp.MustCompile(`(?i)\ssrc\s*=\s*("[^"]*"|'[^']*')`)
+var importImgSrcsetRe = regexp.MustCompile(`(?i)\s(srcset|sizes)\s*=\s*("[^"]*"|'[^']*')`)
+var importMdImgRe = regexp.MustCompile(`!\[([^\]]*)\]\(\s*<?((?:\{\{[^}]*\}\})?[^\s)>]+)>?(\s+"[^"]*")?\s*\)`)
+var liquidTagRe = regexp.MustCompile(`\{\{[^}]*\}\}`)
 
-			w.Header().Set("Content-Type", "application/json")
-			P := makeFprintf(w)
-			P("%s", jsonstr(site))
-			return
-		} else if r.Method == "POST" || r.Method == "PUT" {
-			u := validateApiUser(db, r)
-			if u == nil {
-				http.Error(w, "Invalid user", 401)
-				return
-			}
-			if u.Userid != 1 {
-				http.Error(w, "Not authorized", 401)
-				return
-			}
-			bs, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				handleErr(w, err, "POST apisiteHandler")
-				return
-			}
-			var site Site
-			err = json.Unmarshal(bs, &site)
-			site.Siteid = 1
-			if err != nil {
-				handleErr(w, err, "POST apisiteHandler")
-				return
+// Adds images in entry body as files and returns body with the image
+// links pointing to them. Images that can't be found are left as is.
+func (im *importer) pullImages(ie *ImportEntry, u *User) string {
+	body := importImgRe.ReplaceAllStringFunc(ie.Body, func(tag string) string {
+		m := importImgSrcRe.FindStringSubmatch(tag)
+		if m == nil {
+			return tag
+		}
+		src := unescape(m[1][1 : len(m[1])-1])
+		fileid := im.pullImage(src, ie, u)
+		if fileid == 0 {
+			return tag
+		}
+		// Drop srcset of the old site, resized copies are generated here.
+		tag = importImgSrcsetRe.ReplaceAllString(tag, "")
+		return strings.Replace(tag, m[0], fmt.Sprintf(` src="%s"`, escape(fmt.Sprintf("/?page=file&id=%d", fileid))), 1)
+	})
+	return importMdImgRe.ReplaceAllStringFunc(body, func(s string) string {
+		m := importMdImgRe.FindStringSubmatch(s)
+		fileid := im.pullImage(m[2], ie, u)
+		if fileid == 0 {
+			return s
+		}
+		return fmt.Sprintf("![%s](/?page=file&id=%d%s)", m[1], fileid, m[3])
+	})
+}
+
+// Adds image at src as a file owned by u. Returns file id, or 0 if the
+// image is not found or not from the imported site.
+func (im *importer) pullImage(src string, ie *ImportEntry, u *User) int64 {
+	src = strings.TrimSpace(liquidTagRe.ReplaceAllString(src, ""))
+	if fileid, ok := im.fileids[src]; ok {
+		return fileid
+	}
+	su, err := url.Parse(src)
+	if err != nil || src == "" || strings.HasPrefix(src, "#") {
+		return 0
+	}
+
+	var bs []byte
+	if su.Scheme == "http" || su.Scheme == "https" {
+		if !listContains(im.hosts, strings.ToLower(su.Host)) {
+			return 0
+		}
+		bs, err = fetchImportImage(src, im.hosts)
+	} else if su.Scheme == "" && su.Host == "" && im.fsys != nil {
+		bs, err = im.readImportImage(su.Path, ie.Dir)
+	} else {
+		return 0
+	}
+	if err != nil {
+		im.warnf("Image %s in '%s' not added (%s)", src, ie.Title, err)
+		im.fileids[src] = 0
+		return 0
+	}
+
+	var f File
+	f.Filename = safeFilename(su.Path)
+	f.Title = baseFilename(f.Filename)
+	f.Bytes = bs
+	f.Createdt = ie.Createdt
+	f.Userid = u.Userid
+	fileid, err := createFile(im.db, &f)
+	if err != nil {
+		im.warnf("Image %s in '%s' not added (%s)", src, ie.Title, err)
+		return 0
+	}
+	im.res.Files++
+	im.fileids[src] = fileid
+	return fileid
+}
+
+// Downloads image at src. Redirects are only followed to hosts, and
+// connections to loopback, private and link-local addresses are refused,
+// so an import file can't make the server fetch from its own network.
+func fetchImportImage(src string, hosts []string) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, Control: refuseLocalAddr}
+	client := http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
 			}
-			err = createSite(db, &site)
-			if err != nil {
-				handleErr(w, err, "POST apisiteHandler")
-				return
+			if !listContains(hosts, strings.ToLower(req.URL.Host)) {
+				return fmt.Errorf("redirect to %s not allowed", req.URL.Host)
 			}
+			return nil
+		},
+	}
+	resp, err := client.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	bs, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(bs)) > maxFileSize {
+		return nil, fmt.Errorf("larger than %d bytes", maxFileSize)
+	}
+	if mimetype := http.DetectContentType(bs); !strings.HasPrefix(mimetype, "image/") {
+		return nil, fmt.Errorf("not an image (%s)", mimetype)
+	}
+	return bs, nil
+}
 
-			w.Header().Set("Content-Type", "application/json")
-			P := makeFprintf(w)
-			P("%s", jsonstr(site))
-			return
+// For net.Dialer.Control, refuses connections to addresses that aren't
+// public, after the host name was resolved.
+func refuseLocalAddr(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("address %s not allowed", host)
+	}
+	return nil
+}
+
+// Reads image linked as p from markdown file in dir. Paths starting with /
+// are looked up from the root and from Hugo's static/ directory.
+func (im *importer) readImportImage(p, dir string) ([]byte, error) {
+	var candidates []string
+	if strings.HasPrefix(p, "/") {
+		candidates = []string{path.Join("static", p), strings.TrimPrefix(path.Clean(p), "/")}
+	} else {
+		candidates = []string{path.Join(dir, p), path.Join("static", p)}
+	}
+	for _, c := range candidates {
+		if c == "." || strings.HasPrefix(c, "../") {
+			continue
+		}
+		fi, err := fs.Stat(im.fsys, c)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		if fi.Size() > maxFileSize {
+			return nil, fmt.Errorf("larger than %d bytes", maxFileSize)
 		}
+		return fs.ReadFile(im.fsys, c)
+	}
+	return nil, fmt.Errorf("not found")
+}
 
-		http.Error(w, "Use GET/PUT/POST", 401)
+//*** Scheduled publishing ***
+
+// Source of the current time. Tests can set clock to a fixed time to check
+// what is visible and what gets published at a given moment.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+var clock Clock = systemClock{}
+
+// How often the publisher checks for scheduled entries that are due.
+var publishInterval = time.Minute
+
+// Called after entry e goes public, either when saved as published or when
+// its scheduled publishat time passes. Feeds and pages are generated on each
+// request, so they need no hook.
+// Hooks run at least once per publish: they can run again for the same
+// publish if the server stops while they run.
+type PublishHook func(db *sql.DB, e *Entry)
+
+var publishHooks = []PublishHook{logPublishHook, webhookPublishHook}
+
+// Url that is POSTed a PublishEvent when an entry is published, set by
+// -webhook switch.
+var webhookUrl = ""
+var webhookTimeout = 10 * time.Second
+
+type PublishEvent struct {
+	Event string `json:"event"`
+	Url   string `json:"url"`
+	Entry *Entry `json:"entry"`
+}
+
+func addPublishHook(hook PublishHook) {
+	publishHooks = append(publishHooks, hook)
+}
+
+// Runs publish hooks for e. A failing hook doesn't stop the others.
+func firePublishHooks(db *sql.DB, e *Entry) {
+	if e == nil {
+		return
+	}
+	for _, hook := range publishHooks {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					logf(LogError, "publish hook for entry %d panicked (%v)\n", e.Entryid, r)
+				}
+			}()
+			hook(db, e)
+		}()
 	}
 }
 
-// GET /api/usersettings?id=123
-// POST /api/usersettings {...}
-func apiusersettingsHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "GET" {
-			qid := idtoi(r.FormValue("id"))
-			if qid == 0 {
-				http.Error(w, "Not found.", 404)
-				return
-			}
+// Serializes deliverPublishEvents() so an event isn't delivered twice.
+var publishEventMu sync.Mutex
 
-			us := findUserSettingsById(db, qid)
-			if us == nil {
-				http.Error(w, "Not found.", 404)
-				return
-			}
-			us.BlogAbout = findUserAboutById(db, qid)
+// Records that entry was published, in the transaction that published it.
+func queuePublishEvent(tx *sql.Tx, entryid int64) error {
+	s := "INSERT INTO publish_event (entry_id, createdt) VALUES (?, ?)"
+	_, err := txexec(tx, s, entryid, isodate(clock.Now().UTC()))
+	return err
+}
 
-			w.Header().Set("Content-Type", "application/json")
-			P := makeFprintf(w)
-			P("%s", jsonstr(us))
-			return
-		} else if r.Method == "POST" || r.Method == "PUT" {
-			u := validateApiUser(db, r)
-			if u == nil {
-				http.Error(w, "Invalid user", 401)
-				return
-			}
-			bs, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				handleErr(w, err, "POST apiusersettingsHandler")
-				return
-			}
-			var us UserSettings
-			err = json.Unmarshal(bs, &us)
+// Fires publish hooks for queued publish events, oldest first. An event is
+// removed only after its hooks ran, so events left by a crash or restart
+// are delivered on the next call. Entries deleted or unpublished since are
+// skipped.
+func deliverPublishEvents(db *sql.DB) error {
+	publishEventMu.Lock()
+	defer publishEventMu.Unlock()
+
+	type event struct {
+		eventid int64
+		entryid int64
+	}
+	rows, err := db.Query("SELECT event_id, entry_id FROM publish_event ORDER BY event_id")
+	if err != nil {
+		return err
+	}
+	evs := []event{}
+	for rows.Next() {
+		var ev event
+		rows.Scan(&ev.eventid, &ev.entryid)
+		evs = append(evs, ev)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, ev := range evs {
+		e := findEntry(db, ev.entryid)
+		if e != nil && e.Status == EntryPublished {
+			firePublishHooks(db, e)
+		}
+		_, err := sqlexec(db, "DELETE FROM publish_event WHERE event_id = ?", ev.eventid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func logPublishHook(db *sql.DB, e *Entry) {
+	logf(LogInfo, "Published entry %d '%s'\n", e.Entryid, e.Title)
+}
+
+func webhookPublishHook(db *sql.DB, e *Entry) {
+	if webhookUrl == "" {
+		return
+	}
+	ev := PublishEvent{
+		Event: "publish",
+		Url:   siteBaseUrl + entryurl(e),
+		Entry: e,
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(webhookUrl, "application/json", strings.NewReader(jsonstr(ev)))
+	if err != nil {
+		logErr("webhookPublishHook", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logf(LogWarn, "webhook %s returned %s for entry %d\n", webhookUrl, resp.Status, e.Entryid)
+	}
+}
+
+// Publishes scheduled entries that are due, then fires publish hooks.
+type Publisher struct {
+	db       *sql.DB
+	clock    Clock
+	interval time.Duration
+}
+
+func newPublisher(db *sql.DB, clock Clock) *Publisher {
+	return &Publisher{db: db, clock: clock, interval: publishInterval}
+}
+
+// Changes scheduled entries whose publishat time has passed to published,
+// then delivers publish events, including ones left undelivered by an
+// earlier run. The entry's createdt becomes its publish time, so pages and
+// feeds, which are ordered by createdt, list it by when it went public.
+// Schedules live in the db, so entries that came due while the server was
+// down are published on the next check. Each entry is changed by a single
+// conditional update that queues its publish event in the same
+// transaction, so it is published once and its event survives a crash.
+// Returns the entries published.
+func (p *Publisher) publishDue() ([]*Entry, error) {
+	now := isodate(p.clock.Now().UTC())
+	s := "SELECT entry_id FROM entry WHERE status = ? AND publishat <= ? ORDER BY publishat, entry_id"
+	entryids, err := queryIds(p.db, s, EntryScheduled, now)
+	if err != nil {
+		return nil, err
+	}
+
+	ee := []*Entry{}
+	for _, entryid := range entryids {
+		var published bool
+		err := withWriteTx(p.db, func(tx *sql.Tx) error {
+			s := "UPDATE entry SET status = ?, createdt = publishat, publishat = '' WHERE entry_id = ? AND status = ? AND publishat <= ?"
+			result, err := txexec(tx, s, EntryPublished, entryid, EntryScheduled, now)
 			if err != nil {
-				handleErr(w, err, "POST apiusersettingsHandler")
-				return
+				return err
 			}
-			us.Userid = u.Userid
-			err = createUserSettings(db, &us)
-			if err != nil {
-				handleErr(w, err, "POST apiusersettingsHandler")
-				return
+			n, _ := result.RowsAffected()
+			if n == 0 {
+				// Entry was edited since the select.
+				return nil
 			}
+			published = true
+			return queuePublishEvent(tx, entryid)
+		})
+		if err != nil {
+			return ee, err
+		}
+		if !published {
+			continue
+		}
+		if e := findEntry(p.db, entryid); e != nil {
+			ee = append(ee, e)
+		}
+	}
+	return ee, deliverPublishEvents(p.db)
+}
 
-			w.Header().Set("Content-Type", "application/json")
-			P := makeFprintf(w)
-			P("%s", jsonstr(us))
+// Checks for due entries right away and then every interval, until ctx
+// is done.
+func (p *Publisher) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		_, err := p.publishDue()
+		if err != nil {
+			logErr("publishDue", err)
+		}
+		select {
+		case <-ctx.Done():
 			return
+		case <-ticker.C:
 		}
-
-		http.Error(w, "Use GET/PUT/POST", 401)
 	}
 }
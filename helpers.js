@@ -16,16 +16,16 @@ function readCookie(name) {
 export function currentSession() {
     let suserid = readCookie("userid");
     if (suserid == "") {
-        return {userid: 0, username: "", sig: ""};
+        return {userid: 0, username: "", role: ""};
     }
     let username = readCookie("username");
-    let sig = readCookie("sig");
+    let role = readCookie("role");
 
     let userid = parseInt(suserid, 10);
     return {
         userid: userid,
         username: username,
-        sig: sig,
+        role: role,
     };
 }
 